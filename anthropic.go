@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicVersion   = "2023-06-01"
+	anthropicMaxTokens = 8192
+)
+
+// AnthropicClient is the Provider for the Anthropic Messages API.
+type AnthropicClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+// anthropicBlock is a content block of a request: text, a tool call of the
+// model or the result of one. A cache control on a block caches the request
+// up to and including it.
+type anthropicBlock struct {
+	Type         string                 `json:"type"`
+	Text         string                 `json:"text,omitempty"`
+	ID           string                 `json:"id,omitempty"`          // tool_use
+	Name         string                 `json:"name,omitempty"`        // tool_use
+	Input        json.RawMessage        `json:"input,omitempty"`       // tool_use
+	ToolUseID    string                 `json:"tool_use_id,omitempty"` // tool_result
+	Content      string                 `json:"content,omitempty"`     // tool_result
+	CacheControl *anthropicCacheControl `json:"cache_control,omitempty"`
+}
+
+type anthropicCacheControl struct {
+	Type string `json:"type"`
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens"`
+	System      []anthropicBlock   `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	Temperature float32            `json:"temperature,omitempty"`
+	Tools       []anthropicTool    `json:"tools,omitempty"`
+	Stream      bool               `json:"stream,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicContentBlock struct {
+	Type  string          `json:"type"`
+	Text  string          `json:"text"`
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input"`
+}
+
+// anthropicUsage counts input tokens read from and written to the prompt
+// cache apart from the others.
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+func (u anthropicUsage) usage() Usage {
+	return Usage{
+		InputTokens:       u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens,
+		OutputTokens:      u.OutputTokens,
+		CachedInputTokens: u.CacheReadInputTokens,
+		CacheWriteTokens:  u.CacheCreationInputTokens,
+	}
+}
+
+type anthropicResponse struct {
+	ID         string                  `json:"id"`
+	Model      string                  `json:"model"`
+	Content    []anthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      anthropicUsage          `json:"usage"`
+}
+
+type anthropicErrorResponse struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicStreamEvent covers the fields of all Messages API stream events
+// gopilot cares about.
+type anthropicStreamEvent struct {
+	Type         string                `json:"type"`
+	Message      anthropicResponse     `json:"message"`
+	Index        int                   `json:"index"`
+	ContentBlock anthropicContentBlock `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type anthropicStream struct {
+	body    io.ReadCloser
+	events  *sseReader
+	usage   Usage
+	stopped bool
+}
+
+func newAnthropicClient(config Config) *AnthropicClient {
+	return &AnthropicClient{
+		baseURL:    strings.TrimSuffix(strings.TrimSuffix(config.OrBase, "/"), "/messages"),
+		token:      config.OrToken,
+		httpClient: &http.Client{},
+	}
+}
+
+// anthropicBlocks returns the content blocks of a message. Tool results are
+// sent by the user.
+func anthropicBlocks(m ChatMessage) []anthropicBlock {
+	var blocks []anthropicBlock
+	if m.Role == RoleTool {
+		blocks = append(blocks, anthropicBlock{Type: "tool_result", ToolUseID: m.ToolCallID, Content: m.Content})
+	} else if m.Content != "" {
+		blocks = append(blocks, anthropicBlock{Type: "text", Text: m.Content})
+	}
+	for _, call := range m.ToolCalls {
+		blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Name, Input: call.arguments()})
+	}
+	if m.Cache && len(blocks) > 0 {
+		blocks[len(blocks)-1].CacheControl = &anthropicCacheControl{Type: "ephemeral"}
+	}
+	return blocks
+}
+
+// toAnthropicRequest moves system messages into the system prompt and merges
+// consecutive messages of the same role, as the Messages API requires
+// alternating user and assistant turns. Messages marked Cache get a cache
+// breakpoint.
+func toAnthropicRequest(request ChatRequest) anthropicRequest {
+	result := anthropicRequest{
+		Model:       request.Model,
+		MaxTokens:   request.MaxTokens,
+		Temperature: request.Temperature,
+	}
+	if result.MaxTokens == 0 {
+		result.MaxTokens = anthropicMaxTokens
+	}
+
+	for _, m := range request.Messages {
+		blocks := anthropicBlocks(m)
+		if m.Role == RoleSystem {
+			result.System = append(result.System, blocks...)
+			continue
+		}
+		role := m.Role
+		if role == RoleTool {
+			role = RoleUser
+		}
+		if n := len(result.Messages); n > 0 && result.Messages[n-1].Role == role {
+			result.Messages[n-1].Content = append(result.Messages[n-1].Content, blocks...)
+			continue
+		}
+		result.Messages = append(result.Messages, anthropicMessage{Role: role, Content: blocks})
+	}
+
+	for _, tool := range request.Tools {
+		result.Tools = append(result.Tools, anthropicTool{Name: tool.Name, Description: tool.Description, InputSchema: tool.Parameters})
+	}
+
+	// a trailing assistant message is a prefill, which may not end in
+	// whitespace; one left with no content at all is rejected, so it goes
+	if n := len(result.Messages); n > 0 && result.Messages[n-1].Role == RoleAssistant {
+		last := result.Messages[n-1].Content
+		if k := len(last); k > 0 && last[k-1].Type == "text" {
+			last[k-1].Text = strings.TrimRight(last[k-1].Text, " \t\n")
+			if last[k-1].Text == "" {
+				last = last[:k-1]
+			}
+		}
+		result.Messages[n-1].Content = last
+		if len(last) == 0 {
+			result.Messages = result.Messages[:n-1]
+		}
+	}
+
+	return result
+}
+
+// anthropicFinishReason maps stop reasons onto the OpenAI names used in the
+// rest of gopilot.
+func anthropicFinishReason(stopReason string) string {
+	switch stopReason {
+	case "end_turn", "stop_sequence":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return stopReason
+	}
+}
+
+// anthropicErrorStatus maps the error types sent inside a stream to the HTTP
+// status they would have had, so they can be retried like any other.
+func anthropicErrorStatus(errorType string) int {
+	switch errorType {
+	case "rate_limit_error":
+		return http.StatusTooManyRequests
+	case "overloaded_error":
+		return 529
+	case "api_error":
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// SupportsPrefill is true: the Messages API continues a trailing assistant
+// message.
+func (a *AnthropicClient) SupportsPrefill() bool {
+	return true
+}
+
+func (a *AnthropicClient) post(ctx context.Context, request anthropicRequest) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.baseURL+"/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", a.token)
+	req.Header.Set("anthropic-version", anthropicVersion)
+	if request.Stream {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		content, _ := io.ReadAll(resp.Body)
+		providerErr := &ProviderError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			Err:        fmt.Errorf("anthropic: status %d: %s", resp.StatusCode, strings.TrimSpace(string(content))),
+		}
+		var errResp anthropicErrorResponse
+		if json.Unmarshal(content, &errResp) == nil && errResp.Error.Message != "" {
+			providerErr.Err = fmt.Errorf("anthropic: status %d: %s: %s", resp.StatusCode, errResp.Error.Type, errResp.Error.Message)
+		}
+		return nil, providerErr
+	}
+
+	return resp, nil
+}
+
+func (a *AnthropicClient) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	resp, err := a.post(ctx, toAnthropicRequest(request))
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var response anthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return ChatResponse{}, fmt.Errorf("anthropic: decoding response: %w", err)
+	}
+
+	var content strings.Builder
+	var toolCalls []ToolCall
+	for i, block := range response.Content {
+		switch block.Type {
+		case "text":
+			content.WriteString(block.Text)
+		case "tool_use":
+			toolCalls = append(toolCalls, ToolCall{Index: i, ID: block.ID, Name: block.Name, Arguments: string(block.Input)})
+		}
+	}
+
+	return ChatResponse{
+		Model:        response.Model,
+		Content:      content.String(),
+		ToolCalls:    toolCalls,
+		FinishReason: anthropicFinishReason(response.StopReason),
+		Usage:        response.Usage.usage(),
+	}, nil
+}
+
+func (a *AnthropicClient) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	anthropicReq := toAnthropicRequest(request)
+	anthropicReq.Stream = true
+
+	resp, err := a.post(ctx, anthropicReq)
+	if err != nil {
+		return nil, err
+	}
+
+	return &anthropicStream{body: resp.Body, events: newSSEReader(resp.Body)}, nil
+}
+
+func (s *anthropicStream) Recv() (ChatStreamChunk, error) {
+	for {
+		sse, err := s.events.Next()
+		if errors.Is(err, io.EOF) && !s.stopped {
+			// the connection ended before message_stop
+			return ChatStreamChunk{}, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return ChatStreamChunk{}, err
+		}
+
+		var event anthropicStreamEvent
+		if err := json.Unmarshal([]byte(sse.Data), &event); err != nil {
+			return ChatStreamChunk{}, fmt.Errorf("anthropic: decoding stream event %q: %w", sse.Event, err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			s.usage = event.Message.Usage.usage()
+		case "content_block_start":
+			if event.ContentBlock.Type == "tool_use" {
+				return ChatStreamChunk{ToolCalls: []ToolCall{{Index: event.Index, ID: event.ContentBlock.ID, Name: event.ContentBlock.Name}}}, nil
+			}
+		case "content_block_delta":
+			switch event.Delta.Type {
+			case "text_delta":
+				return ChatStreamChunk{Content: event.Delta.Text}, nil
+			case "input_json_delta":
+				return ChatStreamChunk{ToolCalls: []ToolCall{{Index: event.Index, Arguments: event.Delta.PartialJSON}}}, nil
+			}
+		case "message_delta":
+			s.usage.OutputTokens = event.Usage.OutputTokens
+			if event.Delta.StopReason != "" {
+				return ChatStreamChunk{FinishReason: anthropicFinishReason(event.Delta.StopReason)}, nil
+			}
+		case "message_stop":
+			s.stopped = true
+			return ChatStreamChunk{}, io.EOF
+		case "error":
+			return ChatStreamChunk{}, &ProviderError{
+				StatusCode: anthropicErrorStatus(event.Error.Type),
+				Err:        fmt.Errorf("anthropic: stream error: %s: %s", event.Error.Type, event.Error.Message),
+			}
+		}
+	}
+}
+
+func (s *anthropicStream) Usage() Usage {
+	return s.usage
+}
+
+func (s *anthropicStream) Close() error {
+	return s.body.Close()
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// anthropicEvents writes events in the Messages API stream format.
+func anthropicEvents(events ...string) string {
+	var stream strings.Builder
+	for _, event := range events {
+		var typed struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal([]byte(event), &typed)
+		fmt.Fprintf(&stream, "event: %s\ndata: %s\n\n", typed.Type, event)
+	}
+	return stream.String()
+}
+
+const (
+	anthropicMessageStart = `{"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4","usage":{"input_tokens":20,"cache_creation_input_tokens":100,"cache_read_input_tokens":300,"output_tokens":1}}}`
+	anthropicMessageStop  = `{"type":"message_stop"}`
+)
+
+func TestAnthropicStream(t *testing.T) {
+	usage := Usage{InputTokens: 420, OutputTokens: 12, CachedInputTokens: 300, CacheWriteTokens: 100}
+	tests := []struct {
+		name         string
+		stream       string
+		content      string
+		calls        []ToolCall
+		finishReason string
+		usage        Usage
+		status       int // of the ProviderError the stream ends with, 0 for io.EOF
+		err          error
+	}{
+		{
+			name: "text",
+			stream: anthropicEvents(
+				anthropicMessageStart,
+				`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+				`{"type":"ping"}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":", world"}}`,
+				`{"type":"content_block_stop","index":0}`,
+				`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":12}}`,
+				anthropicMessageStop,
+			),
+			content:      "Hello, world",
+			finishReason: "stop",
+			usage:        usage,
+		},
+		{
+			name: "tool use",
+			stream: anthropicEvents(
+				anthropicMessageStart,
+				`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Writing a.go"}}`,
+				`{"type":"content_block_stop","index":0}`,
+				`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"write_file","input":{}}}`,
+				`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"filepath\":"}}`,
+				`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"a.go\"}"}}`,
+				`{"type":"content_block_stop","index":1}`,
+				`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":12}}`,
+				anthropicMessageStop,
+			),
+			content:      "Writing a.go",
+			calls:        []ToolCall{{Index: 1, ID: "toolu_1", Name: "write_file", Arguments: `{"filepath":"a.go"}`}},
+			finishReason: "tool_calls",
+			usage:        usage,
+		},
+		{
+			name: "cut off",
+			stream: anthropicEvents(
+				anthropicMessageStart,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+			),
+			content: "Hel",
+			usage:   Usage{InputTokens: 420, OutputTokens: 1, CachedInputTokens: 300, CacheWriteTokens: 100},
+			err:     io.ErrUnexpectedEOF,
+		},
+		{
+			name: "overloaded",
+			stream: anthropicEvents(
+				anthropicMessageStart,
+				`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			),
+			usage:  Usage{InputTokens: 420, OutputTokens: 1, CachedInputTokens: 300, CacheWriteTokens: 100},
+			status: 529,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprint(w, tt.stream)
+			}))
+			defer server.Close()
+
+			client := newAnthropicClient(Config{OrBase: server.URL, OrToken: "test"})
+			stream, err := client.CreateChatCompletionStream(context.Background(), ChatRequest{
+				Model:    "claude-sonnet-4",
+				Messages: []ChatMessage{{Role: RoleUser, Content: "hi"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+
+			var content strings.Builder
+			var calls []ToolCall
+			var finishReason string
+			for {
+				var chunk ChatStreamChunk
+				chunk, err = stream.Recv()
+				if err != nil {
+					break
+				}
+				content.WriteString(chunk.Content)
+				calls = addToolCalls(calls, chunk.ToolCalls)
+				if chunk.FinishReason != "" {
+					finishReason = chunk.FinishReason
+				}
+			}
+
+			var providerErr *ProviderError
+			switch {
+			case tt.status != 0:
+				if !errors.As(err, &providerErr) || providerErr.StatusCode != tt.status {
+					t.Errorf("stream ended with %v, want a provider error with status %d", err, tt.status)
+				}
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Errorf("stream ended with %v, want %v", err, tt.err)
+				}
+			case !errors.Is(err, io.EOF):
+				t.Errorf("stream ended with %v, want io.EOF", err)
+			}
+			if got := content.String(); got != tt.content {
+				t.Errorf("content = %q, want %q", got, tt.content)
+			}
+			if !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("tool calls = %+v, want %+v", calls, tt.calls)
+			}
+			if finishReason != tt.finishReason {
+				t.Errorf("finish reason = %q, want %q", finishReason, tt.finishReason)
+			}
+			if got := stream.Usage(); got != tt.usage {
+				t.Errorf("usage = %+v, want %+v", got, tt.usage)
+			}
+		})
+	}
+}
+
+func TestAnthropicRequest(t *testing.T) {
+	var request anthropicRequest
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/messages" {
+			t.Errorf("request to %s, want /messages", r.URL.Path)
+		}
+		header = r.Header
+		json.NewDecoder(r.Body).Decode(&request)
+		fmt.Fprint(w, `{"id":"msg_1","model":"claude-sonnet-4","content":[{"type":"text","text":"[]"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":1}}`)
+	}))
+	defer server.Close()
+
+	client := newAnthropicClient(Config{OrBase: server.URL + "/messages", OrToken: "secret"})
+	response, err := client.CreateChatCompletion(context.Background(), ChatRequest{
+		Model: "claude-sonnet-4",
+		Messages: []ChatMessage{
+			{Role: RoleSystem, Content: "You write Go."},
+			{Role: RoleSystem, Content: "The files.", Cache: true},
+			{Role: RoleUser, Content: "earlier prompt"},
+			{Role: RoleAssistant, ToolCalls: []ToolCall{{ID: "toolu_1", Name: "write_file", Arguments: "not json"}}},
+			{Role: RoleTool, ToolCallID: "toolu_1", Content: "ok"},
+			{Role: RoleUser, Content: "the prompt"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ChatResponse{Model: "claude-sonnet-4", Content: "[]", FinishReason: "stop", Usage: Usage{InputTokens: 10, OutputTokens: 1}}
+	if !reflect.DeepEqual(response, want) {
+		t.Errorf("response = %+v, want %+v", response, want)
+	}
+	if header.Get("x-api-key") != "secret" || header.Get("anthropic-version") != anthropicVersion {
+		t.Errorf("headers = %v, want the key and the API version", header)
+	}
+	wantSystem := []anthropicBlock{
+		{Type: "text", Text: "You write Go."},
+		{Type: "text", Text: "The files.", CacheControl: &anthropicCacheControl{Type: "ephemeral"}},
+	}
+	if !reflect.DeepEqual(request.System, wantSystem) {
+		t.Errorf("system = %+v, want %+v", request.System, wantSystem)
+	}
+	// the tool result and the prompt make one user turn
+	wantMessages := []anthropicMessage{
+		{Role: RoleUser, Content: []anthropicBlock{{Type: "text", Text: "earlier prompt"}}},
+		{Role: RoleAssistant, Content: []anthropicBlock{{Type: "tool_use", ID: "toolu_1", Name: "write_file", Input: json.RawMessage("{}")}}},
+		{Role: RoleUser, Content: []anthropicBlock{
+			{Type: "tool_result", ToolUseID: "toolu_1", Content: "ok"},
+			{Type: "text", Text: "the prompt"},
+		}},
+	}
+	if !reflect.DeepEqual(request.Messages, wantMessages) {
+		t.Errorf("messages = %+v, want %+v", request.Messages, wantMessages)
+	}
+	if request.MaxTokens != anthropicMaxTokens {
+		t.Errorf("max tokens = %d, want the default %d", request.MaxTokens, anthropicMaxTokens)
+	}
+}
+
+func TestAnthropicPrefill(t *testing.T) {
+	prompt := anthropicMessage{Role: RoleUser, Content: []anthropicBlock{{Type: "text", Text: "the prompt"}}}
+	call := ToolCall{ID: "toolu_1", Name: "write_file", Arguments: `{"filepath":"a.go"}`}
+	tests := []struct {
+		name    string
+		prefill ChatMessage
+		want    []anthropicMessage
+	}{
+		{
+			name:    "trailing whitespace is trimmed",
+			prefill: ChatMessage{Role: RoleAssistant, Content: "[\n  "},
+			want:    []anthropicMessage{prompt, {Role: RoleAssistant, Content: []anthropicBlock{{Type: "text", Text: "["}}}},
+		},
+		{
+			name:    "no content",
+			prefill: ChatMessage{Role: RoleAssistant},
+			want:    []anthropicMessage{prompt},
+		},
+		{
+			name:    "only whitespace",
+			prefill: ChatMessage{Role: RoleAssistant, Content: " \n"},
+			want:    []anthropicMessage{prompt},
+		},
+		{
+			name:    "ends in a tool call",
+			prefill: ChatMessage{Role: RoleAssistant, Content: "Writing a.go ", ToolCalls: []ToolCall{call}},
+			want: []anthropicMessage{prompt, {Role: RoleAssistant, Content: []anthropicBlock{
+				{Type: "text", Text: "Writing a.go "},
+				{Type: "tool_use", ID: "toolu_1", Name: "write_file", Input: json.RawMessage(call.Arguments)},
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := toAnthropicRequest(ChatRequest{
+				Model:    "claude-sonnet-4",
+				Messages: []ChatMessage{{Role: RoleUser, Content: "the prompt"}, tt.prefill},
+			})
+			if !reflect.DeepEqual(request.Messages, tt.want) {
+				t.Errorf("messages = %+v, want %+v", request.Messages, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultBudgetWarn = 80
+
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Budget limits what a run may spend. Zero means no limit.
+type Budget struct {
+	Session     float64
+	Daily       float64
+	WarnPercent float64
+}
+
+// spendLedger is the spending per day across all runs, kept in the user's
+// config directory so the daily budget holds over several invocations.
+type spendLedger struct {
+	mu     sync.Mutex
+	path   string
+	Days   map[string]float64 `json:"days"`
+	loaded bool
+}
+
+var dailySpend = &spendLedger{}
+
+// budgetWarned remembers which budgets we already warned about.
+var budgetWarned = map[string]bool{}
+
+func userConfigDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "gopilot")
+}
+
+func today() string {
+	return time.Now().Format("2006-01-02")
+}
+
+func (l *spendLedger) load() {
+	if l.loaded {
+		return
+	}
+	l.loaded = true
+	l.path = filepath.Join(userConfigDir(), "spend.json")
+	l.Days = map[string]float64{}
+
+	content, err := os.ReadFile(l.path)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(content, l); err != nil {
+		log.Printf("Warning: could not read %s: %v", l.path, err)
+	}
+	if l.Days == nil {
+		l.Days = map[string]float64{}
+	}
+}
+
+func (l *spendLedger) today() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.load()
+	return l.Days[today()]
+}
+
+// add records cost for today and forgets days older than a month.
+func (l *spendLedger) add(cost float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.load()
+	l.Days[today()] += cost
+
+	cutoff := time.Now().AddDate(0, -1, 0).Format("2006-01-02")
+	for day := range l.Days {
+		if day < cutoff {
+			delete(l.Days, day)
+		}
+	}
+
+	content, err := json.MarshalIndent(l, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(l.path), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(l.path, content, 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: could not save daily spending to %s: %v", l.path, err)
+	}
+}
+
+// checkBudget is Budget.check for a request about to be made.
+func checkBudget(b Budget) error {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	return b.check()
+}
+
+// check returns ErrBudgetExceeded when the session or today's spending has
+// reached its limit, and warns once when it gets close.
+func (b Budget) check() error {
+	spent := currentSession.TotalCost
+	if b.Session > 0 {
+		if spent >= b.Session {
+			return fmt.Errorf("%w: spent $%.2f of the $%.2f session budget", ErrBudgetExceeded, spent, b.Session)
+		}
+		b.warn("session", spent, b.Session)
+	}
+
+	if b.Daily > 0 {
+		spentToday := dailySpend.today()
+		if spentToday >= b.Daily {
+			return fmt.Errorf("%w: spent $%.2f of the $%.2f daily budget", ErrBudgetExceeded, spentToday, b.Daily)
+		}
+		b.warn("daily", spentToday, b.Daily)
+	}
+	return nil
+}
+
+func (b Budget) warn(name string, spent, limit float64) {
+	if b.WarnPercent <= 0 || budgetWarned[name] || spent < limit*b.WarnPercent/100 {
+		return
+	}
+	budgetWarned[name] = true
+	log.Printf("Warning: spent $%.2f, %.0f%% of the $%.2f %s budget", spent, spent/limit*100, limit, name)
+}
+
+// stopIfBudgetExceeded ends a run that went over its budget and returns err.
+// The error is passed up from where the request failed, so nothing is
+// applied after it. .go files are recreated from the .gopart files so they
+// match what was applied so far, and the changes are left uncommitted on the
+// current branch.
+func stopIfBudgetExceeded(config Config, err error) error {
+	if err == nil {
+		return nil
+	}
+	fmt.Println("Stopping:", err)
+	if !config.NoGopart {
+		if _, statErr := os.Stat("editor"); statErr == nil {
+			goFiles, globErr := filepath.Glob("*.go")
+			if globErr != nil {
+				log.Fatal("Error finding Go files:", globErr)
+			}
+			unsplitGoFiles(".", strings.Join(goFiles, ","))
+		}
+	}
+
+	fmt.Printf("Changes applied so far are left uncommitted on branch %s.\n", getCurrentBranch())
+	return err
+}
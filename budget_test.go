@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// useSpending sets what the session and today have spent so far.
+func useSpending(t *testing.T, session, daily float64) {
+	savedSession, savedLedger, savedWarned := currentSession, dailySpend, budgetWarned
+	t.Cleanup(func() {
+		currentSession, dailySpend, budgetWarned = savedSession, savedLedger, savedWarned
+	})
+	currentSession = Session{TotalCost: session}
+	dailySpend = &spendLedger{loaded: true, Days: map[string]float64{today(): daily}}
+	budgetWarned = map[string]bool{}
+}
+
+func TestBudgetCheck(t *testing.T) {
+	tests := []struct {
+		name          string
+		budget        Budget
+		session       float64
+		daily         float64
+		wantExceeded  bool
+		wantWarnedFor string
+	}{
+		{name: "no budgets", session: 100, daily: 100},
+		{name: "under the session budget", budget: Budget{Session: 2}, session: 1},
+		{name: "session budget used up", budget: Budget{Session: 2}, session: 2, wantExceeded: true},
+		{name: "under the daily budget", budget: Budget{Daily: 10}, daily: 5},
+		{name: "daily budget used up", budget: Budget{Session: 2, Daily: 10}, session: 1, daily: 11, wantExceeded: true},
+		{name: "close to the session budget", budget: Budget{Session: 2, WarnPercent: 80}, session: 1.8, wantWarnedFor: "session"},
+		{name: "close to the daily budget", budget: Budget{Daily: 10, WarnPercent: 80}, daily: 9, wantWarnedFor: "daily"},
+		{name: "no warning below the threshold", budget: Budget{Session: 2, WarnPercent: 80}, session: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSpending(t, tt.session, tt.daily)
+
+			err := checkBudget(tt.budget)
+			if got := errors.Is(err, ErrBudgetExceeded); got != tt.wantExceeded {
+				t.Errorf("checkBudget() = %v, want exceeded %v", err, tt.wantExceeded)
+			}
+			for _, name := range []string{"session", "daily"} {
+				if got := budgetWarned[name]; got != (name == tt.wantWarnedFor) {
+					t.Errorf("warned about the %s budget = %v", name, got)
+				}
+			}
+		})
+	}
+}
+
+// chargingProvider fails every request with a retryable error, charging
+// cost for each.
+type chargingProvider struct {
+	cost     float64
+	attempts int
+}
+
+func (p *chargingProvider) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	p.attempts++
+	currentSession.TotalCost += p.cost
+	return ChatResponse{}, &ProviderError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Millisecond, Err: errors.New("overloaded")}
+}
+
+func (p *chargingProvider) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	_, err := p.CreateChatCompletion(ctx, request)
+	return nil, err
+}
+
+func TestRetriesStopAtTheBudget(t *testing.T) {
+	useSpending(t, 0, 0)
+	backend := &chargingProvider{cost: 1}
+	client := &retryProvider{Provider: backend, maxRetries: 5, budget: Budget{Session: 2}}
+
+	_, err := client.CreateChatCompletion(context.Background(), ChatRequest{})
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("CreateChatCompletion() = %v, want ErrBudgetExceeded", err)
+	}
+	if backend.attempts != 2 {
+		t.Errorf("made %d attempts, want 2", backend.attempts)
+	}
+}
+
+func TestGenerateChangesReturnsBudgetError(t *testing.T) {
+	fake := useFakeProvider(t)
+	useSpending(t, 3, 0)
+	config := testConfig()
+	config.Prompt = "Add a run function"
+	config.NoRouting = true
+	config.Budget = Budget{Session: 2}
+
+	changes, err := generateChanges(context.Background(), config, []FileContent{{FilePath: "main.go", Content: "package main\n"}})
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("generateChanges() error = %v, want ErrBudgetExceeded", err)
+	}
+	if changes != nil {
+		t.Errorf("generateChanges() = %+v, want no changes", changes)
+	}
+	if len(fake.requests) != 0 {
+		t.Errorf("sent %d requests over the budget", len(fake.requests))
+	}
+}
+
+func TestDefaultCommitMessage(t *testing.T) {
+	tests := []struct {
+		prompt string
+		want   string
+	}{
+		{prompt: "Add retries\n\nUse exponential backoff.", want: "Add retries"},
+		{prompt: "  Fix the parser  ", want: "Fix the parser"},
+		{prompt: "", want: "Changes made by gopilot"},
+	}
+	for _, tt := range tests {
+		if got := defaultCommitMessage(Config{Prompt: tt.prompt}); got != tt.want {
+			t.Errorf("defaultCommitMessage(%q) = %q, want %q", tt.prompt, got, tt.want)
+		}
+	}
+}
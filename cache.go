@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCacheTTL     = 24 * time.Hour
+	defaultCacheMaxSize = 100 // MB
+)
+
+// CacheConfig controls the on-disk response cache in .gopilot/cache.
+type CacheConfig struct {
+	Disabled bool
+	TTL      time.Duration
+	MaxSize  int64 // MB
+	Prune    bool
+}
+
+type cacheEntry struct {
+	Created      time.Time  `json:"created"`
+	Model        string     `json:"model"`
+	Content      string     `json:"content"`
+	ToolCalls    []ToolCall `json:"tool_calls,omitempty"`
+	FinishReason string     `json:"finish_reason"`
+}
+
+// cacheProvider answers requests it has seen before from disk. A request is
+// identified by backend, model, messages and parameters. Only complete
+// responses are stored: those that say they stopped or called tools.
+type cacheProvider struct {
+	Provider
+	dir     string
+	backend string
+	config  CacheConfig
+}
+
+// gopilotDir returns .gopilot/<sub> in the project, creating it with a
+// .gitignore so gopilot's own state never ends up in a commit.
+func gopilotDir(sub string) string {
+	dir := filepath.Join(".gopilot", sub)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Error creating directory %s: %v", dir, err)
+	}
+	ignore := filepath.Join(dir, ".gitignore")
+	if _, err := os.Stat(ignore); os.IsNotExist(err) {
+		os.WriteFile(ignore, []byte("*\n"), 0644)
+	}
+	return dir
+}
+
+func newCacheProvider(provider Provider, config Config) *cacheProvider {
+	return &cacheProvider{
+		Provider: provider,
+		dir:      gopilotDir("cache"),
+		backend:  config.Provider + " " + config.OrBase,
+		config:   config.Cache,
+	}
+}
+
+func (c *cacheProvider) key(request ChatRequest) string {
+	content, _ := json.Marshal(struct {
+		Backend string
+		ChatRequest
+	}{c.backend, request})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *cacheProvider) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *cacheProvider) get(request ChatRequest) (cacheEntry, bool) {
+	content, err := os.ReadFile(c.path(c.key(request)))
+	if err != nil {
+		return cacheEntry{}, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return cacheEntry{}, false
+	}
+	if time.Since(entry.Created) > c.config.TTL {
+		return cacheEntry{}, false
+	}
+
+	sessionMu.Lock()
+	currentSession.CacheHits++
+	sessionMu.Unlock()
+	fmt.Println("Using cached response for", request.Model)
+	return entry, true
+}
+
+func (c *cacheProvider) put(request ChatRequest, entry cacheEntry) {
+	if entry.Content == "" && len(entry.ToolCalls) == 0 {
+		return
+	}
+	if entry.FinishReason != "stop" && entry.FinishReason != "tool_calls" {
+		return
+	}
+	entry.Created = time.Now()
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(c.path(c.key(request)), content, 0644); err != nil {
+		log.Printf("Warning: could not write cache entry: %v", err)
+		return
+	}
+	pruneCache(c.dir, c.config)
+}
+
+func (c *cacheProvider) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	if entry, ok := c.get(request); ok {
+		return ChatResponse{Model: entry.Model, Content: entry.Content, ToolCalls: entry.ToolCalls, FinishReason: entry.FinishReason}, nil
+	}
+
+	response, err := c.Provider.CreateChatCompletion(ctx, request)
+	if err == nil {
+		c.put(request, cacheEntry{Model: response.Model, Content: response.Content, ToolCalls: response.ToolCalls, FinishReason: response.FinishReason})
+	}
+	return response, err
+}
+
+func (c *cacheProvider) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	if entry, ok := c.get(request); ok {
+		return &cachedStream{chunks: []ChatStreamChunk{{Content: entry.Content, ToolCalls: entry.ToolCalls, FinishReason: entry.FinishReason}}}, nil
+	}
+
+	stream, err := c.Provider.CreateChatCompletionStream(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingStream{ChatStream: stream, cache: c, request: request}, nil
+}
+
+// cachingStream stores the streamed response once it is complete.
+type cachingStream struct {
+	ChatStream
+	cache        *cacheProvider
+	request      ChatRequest
+	content      strings.Builder
+	toolCalls    []ToolCall
+	finishReason string
+}
+
+func (s *cachingStream) Recv() (ChatStreamChunk, error) {
+	chunk, err := s.ChatStream.Recv()
+	if err == nil {
+		if chunk.Reset {
+			s.content.Reset()
+			s.toolCalls = nil
+		}
+		s.content.WriteString(chunk.Content)
+		s.toolCalls = addToolCalls(s.toolCalls, chunk.ToolCalls)
+		if chunk.FinishReason != "" {
+			s.finishReason = chunk.FinishReason
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		s.cache.put(s.request, cacheEntry{Model: s.request.Model, Content: s.content.String(), ToolCalls: s.toolCalls, FinishReason: s.finishReason})
+	}
+	return chunk, err
+}
+
+// cachedStream replays a fixed list of chunks.
+type cachedStream struct {
+	chunks []ChatStreamChunk
+}
+
+func (s *cachedStream) Recv() (ChatStreamChunk, error) {
+	if len(s.chunks) == 0 {
+		return ChatStreamChunk{}, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+func (s *cachedStream) Usage() Usage {
+	return Usage{}
+}
+
+func (s *cachedStream) Close() error {
+	return nil
+}
+
+// pruneCache removes expired entries and then the oldest ones until the
+// cache fits in its size limit.
+func pruneCache(dir string, config CacheConfig) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	type cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cacheFile
+	var total int64
+	removed := 0
+
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		if time.Since(info.ModTime()) > config.TTL {
+			if os.Remove(path) == nil {
+				removed++
+			}
+			continue
+		}
+		files = append(files, cacheFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	maxSize := config.MaxSize * 1024 * 1024
+	for _, f := range files {
+		if total <= maxSize {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			removed++
+			total -= f.size
+		}
+	}
+
+	return removed, nil
+}
+
+func pruneCacheCommand(config Config) {
+	dir := gopilotDir("cache")
+	removed, err := pruneCache(dir, config.Cache)
+	if err != nil {
+		log.Fatalf("Error pruning cache: %v", err)
+	}
+	fmt.Printf("Removed %d cache entries from %s\n", removed, dir)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPruneCache(t *testing.T) {
+	const mb = 1024 * 1024
+	now := time.Now()
+	tests := []struct {
+		name    string
+		files   map[string]time.Duration // age of each entry
+		sizeMB  int64                    // of each entry
+		config  CacheConfig
+		removed int
+		kept    []string
+	}{
+		{
+			name:    "nothing to do",
+			files:   map[string]time.Duration{"a.json": time.Hour, "b.json": 2 * time.Hour},
+			sizeMB:  1,
+			config:  CacheConfig{TTL: 24 * time.Hour, MaxSize: 10},
+			removed: 0,
+			kept:    []string{"a.json", "b.json"},
+		},
+		{
+			name:    "expired entries",
+			files:   map[string]time.Duration{"new.json": time.Hour, "old.json": 48 * time.Hour},
+			sizeMB:  1,
+			config:  CacheConfig{TTL: 24 * time.Hour, MaxSize: 10},
+			removed: 1,
+			kept:    []string{"new.json"},
+		},
+		{
+			name:    "oldest entries go over the size limit",
+			files:   map[string]time.Duration{"a.json": time.Hour, "b.json": 2 * time.Hour, "c.json": 3 * time.Hour},
+			sizeMB:  1,
+			config:  CacheConfig{TTL: 24 * time.Hour, MaxSize: 2},
+			removed: 1,
+			kept:    []string{"a.json", "b.json"},
+		},
+		{
+			name:    "other files are left alone",
+			files:   map[string]time.Duration{".gitignore": 48 * time.Hour, "a.json": 48 * time.Hour},
+			sizeMB:  0,
+			config:  CacheConfig{TTL: 24 * time.Hour, MaxSize: 10},
+			removed: 1,
+			kept:    []string{".gitignore"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, age := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.WriteFile(path, make([]byte, tt.sizeMB*mb), 0644); err != nil {
+					t.Fatal(err)
+				}
+				os.Chtimes(path, now.Add(-age), now.Add(-age))
+			}
+
+			removed, err := pruneCache(dir, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != tt.removed {
+				t.Errorf("removed %d entries, want %d", removed, tt.removed)
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != len(tt.kept) {
+				t.Errorf("%d entries left, want %v", len(entries), tt.kept)
+			}
+			for _, name := range tt.kept {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("%s was removed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	cache := &cacheProvider{backend: "openai https://openrouter.ai/api/v1"}
+	request := ChatRequest{Model: "openai/gpt-4o", Messages: []ChatMessage{{Role: RoleUser, Content: "hi"}}}
+	key := cache.key(request)
+
+	if cache.key(request) != key {
+		t.Error("the same request has different keys")
+	}
+	tests := []struct {
+		name    string
+		backend string
+		change  func(r *ChatRequest)
+	}{
+		{"backend", "anthropic https://api.anthropic.com/v1", func(r *ChatRequest) {}},
+		{"model", cache.backend, func(r *ChatRequest) { r.Model = "openai/gpt-4o-mini" }},
+		{"message", cache.backend, func(r *ChatRequest) { r.Messages = []ChatMessage{{Role: RoleUser, Content: "hello"}} }},
+		{"role", cache.backend, func(r *ChatRequest) { r.Messages = []ChatMessage{{Role: RoleSystem, Content: "hi"}} }},
+		{"temperature", cache.backend, func(r *ChatRequest) { r.Temperature = 0.5 }},
+		{"response format", cache.backend, func(r *ChatRequest) { r.ResponseFormat = changesFormat }},
+	}
+	for _, tt := range tests {
+		other := request
+		tt.change(&other)
+		if (&cacheProvider{backend: tt.backend}).key(other) == key {
+			t.Errorf("a different %s has the same key", tt.name)
+		}
+	}
+}
+
+func TestCacheStoresCompleteResponses(t *testing.T) {
+	tests := []struct {
+		finishReason string
+		stored       bool
+	}{
+		{"stop", true},
+		{"tool_calls", true},
+		{"length", false},
+		{"", false}, // a backend that doesn't say how it ended
+	}
+	for _, tt := range tests {
+		fake := useFakeProvider(t, ChatResponse{Content: "[]", FinishReason: tt.finishReason})
+		cache := &cacheProvider{Provider: fake, dir: t.TempDir(), config: CacheConfig{TTL: time.Hour, MaxSize: 1}}
+		request := ChatRequest{Model: "fake", Messages: []ChatMessage{{Role: RoleUser, Content: "hi"}}}
+
+		if _, err := cache.CreateChatCompletion(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+		if _, stored := cache.get(request); stored != tt.stored {
+			t.Errorf("finish reason %q: stored = %v, want %v", tt.finishReason, stored, tt.stored)
+		}
+	}
+}
+
+func TestRepairsBypassTheCache(t *testing.T) {
+	wd, _ := os.Getwd()
+	t.Cleanup(func() { os.Chdir(wd) })
+	os.Chdir(t.TempDir())
+
+	for _, task := range []string{"", taskSmallFix, taskBuildRepair, taskTestRepair} {
+		useFakeProvider(t)
+		config := Config{Task: task}
+		config.Cache.TTL = time.Hour
+		_, cached := createProvider(config).(*cacheProvider)
+		if want := task != taskBuildRepair && task != taskTestRepair; cached != want {
+			t.Errorf("task %q: cached = %v, want %v", task, cached, want)
+		}
+	}
+}
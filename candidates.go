@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultCandidateParallel = 4
+
+// CandidateConfig controls best-of-N generation: Count change sets are
+// generated, Parallel at a time, each is built in a copy of the project, and
+// the best one is kept.
+type CandidateConfig struct {
+	Count        int
+	Parallel     int
+	Temperatures []float32
+	Tests        bool
+}
+
+type candidate struct {
+	number      int
+	temperature float32
+	model       string
+	changes     []FileContent
+	builds      bool
+	testsPass   bool
+}
+
+func parseTemperatures(s string) []float32 {
+	var temperatures []float32
+	for _, item := range splitList(s) {
+		t, err := strconv.ParseFloat(item, 32)
+		if err != nil {
+			log.Fatalf("Invalid candidate temperature %q: %v", item, err)
+		}
+		temperatures = append(temperatures, float32(t))
+	}
+	return temperatures
+}
+
+// temperature returns the temperature of candidate i: the configured ones in
+// turn, or else spread evenly from 0.2 to 1.0.
+func (c CandidateConfig) temperature(i int) float32 {
+	if len(c.Temperatures) > 0 {
+		return c.Temperatures[i%len(c.Temperatures)]
+	}
+	if c.Count < 2 {
+		return 0.2
+	}
+	return 0.2 + 0.8*float32(i)/float32(c.Count-1)
+}
+
+// score ranks candidates: passing tests beats building, which beats
+// failing. A candidate without changes comes last.
+func (c candidate) score() int {
+	switch {
+	case len(c.changes) == 0:
+		return -1
+	case c.builds && c.testsPass:
+		return 2
+	case c.builds:
+		return 1
+	}
+	return 0
+}
+
+func (c candidate) result(tests bool) string {
+	switch {
+	case len(c.changes) == 0:
+		return "no changes"
+	case !c.builds:
+		return "build failed"
+	case !tests:
+		return "builds"
+	case c.testsPass:
+		return "builds, tests pass"
+	}
+	return "builds, tests fail"
+}
+
+// bestCandidate asks for config.Candidates.Count change sets at different
+// temperatures from models and returns the changes of the best one.
+// The candidates are generated concurrently, config.Candidates.Parallel at a
+// time, and then evaluated one after another. Ties go to the earlier, cooler
+// candidate. The split order is not updated yet. Running out of budget is
+// returned when it stopped every candidate.
+func bestCandidate(ctx context.Context, config Config, client Provider, models []string, request ChatRequest) ([]FileContent, error) {
+	parallel := config.Candidates.Parallel
+	if parallel < 1 || config.Record != "" || config.Replay != "" {
+		// a cassette holds the requests in the order they were made
+		parallel = 1
+	}
+	fmt.Printf("Generating %d candidates, %d at a time...\n", config.Candidates.Count, parallel)
+
+	type generation struct {
+		temperature float32
+		response    ChatResponse
+		err         error
+	}
+	generations := make([]generation, config.Candidates.Count)
+	limit := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i := range generations {
+		generations[i].temperature = config.Candidates.temperature(i)
+		wg.Add(1)
+		go func(g *generation) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			request := request
+			request.Temperature = g.temperature
+			g.response, g.err = generateCandidate(ctx, config, client, models, request)
+		}(&generations[i])
+	}
+	wg.Wait()
+
+	var best *candidate
+	var budgetErr error
+	for i, g := range generations {
+		if g.err != nil {
+			exitIfInterrupted(ctx)
+			if errors.Is(g.err, ErrBudgetExceeded) {
+				budgetErr = g.err
+				continue
+			}
+			log.Printf("Warning: candidate %d failed: %v", i+1, g.err)
+			continue
+		}
+
+		c := &candidate{
+			number:      i + 1,
+			temperature: g.temperature,
+			model:       g.response.Model,
+			changes:     responseChanges(ctx, config, g.response),
+		}
+		if len(c.changes) > 0 {
+			evaluateCandidate(ctx, config, ".", c)
+		}
+		fmt.Printf("Candidate %d (temperature %.2f): %s\n", c.number, c.temperature, c.result(config.Candidates.Tests))
+
+		if best == nil || c.score() > best.score() {
+			best = c
+		}
+	}
+
+	if best == nil {
+		if budgetErr != nil {
+			return nil, budgetErr
+		}
+		log.Fatal("All candidates failed in generateChanges")
+	}
+	fmt.Printf("Keeping candidate %d (%s), generated by %s\n", best.number, best.result(config.Candidates.Tests), best.model)
+	currentSession.ChangesModel = best.model
+	return best.changes, nil
+}
+
+// generateCandidate asks models in turn for the changes of one candidate.
+// Once a model started calling tools, it gets the results.
+func generateCandidate(ctx context.Context, config Config, client Provider, models []string, request ChatRequest) (ChatResponse, error) {
+	var model string
+	return completeWithTools(".", request, func(request ChatRequest) (ChatResponse, error) {
+		if model != "" {
+			request.Model = model
+			return client.CreateChatCompletion(ctx, request)
+		}
+		response, err := completeRequest(ctx, client, config, models, request)
+		model = response.Model
+		return response, err
+	})
+}
+
+// evaluateCandidate applies the changes of c to a copy of the project in
+// project and builds it there the way the changes would be built in the
+// project, and runs the tests when asked to.
+func evaluateCandidate(ctx context.Context, config Config, project string, c *candidate) {
+	dir, err := os.MkdirTemp("", "gopilot-candidate-")
+	if err != nil {
+		log.Fatal("Error creating candidate directory:", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx = removeOnInterrupt(ctx, dir)
+	if err := copyTree(project, dir); err != nil {
+		log.Printf("Warning: could not copy the project for candidate %d: %v", c.number, err)
+		return
+	}
+
+	// candidate builds are not part of the conversation
+	conversation := currentConversation
+	currentConversation = nil
+	defer func() { currentConversation = conversation }()
+
+	applyChanges(ctx, dir, processLocations(dir, append([]FileContent(nil), c.changes...)))
+	if !config.NoGopart {
+		goFiles, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		if err != nil {
+			log.Fatal("Error finding Go files:", err)
+		}
+		for i, file := range goFiles {
+			goFiles[i] = filepath.Base(file)
+		}
+		unsplitGoFiles(dir, strings.Join(goFiles, ","))
+	}
+	// a candidate that adds an import needs it in go.mod to build
+	if err := syncDependencies(ctx, dir); err != nil {
+		exitIfInterrupted(ctx)
+		log.Printf("Warning: candidate %d: %v", c.number, err)
+		return
+	}
+	runGoimports(ctx, dir)
+
+	c.builds = buildSucceeds(ctx, dir)
+	if c.builds && config.Candidates.Tests {
+		cmd := exec.CommandContext(ctx, "make", "test")
+		cmd.Dir = dir
+		c.testsPass = cmd.Run() == nil
+		exitIfInterrupted(ctx)
+	}
+}
+
+// copyTree copies the project in src to dst, leaving out git's and
+// gopilot's own state.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != src && (d.Name() == ".git" || d.Name() == ".gopilot") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(target, content, info.Mode().Perm())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyTree(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	for path, content := range map[string]string{
+		"main.go":               "package main\n",
+		"editor/main/a.gopart":  "func a() {}\n",
+		".git/HEAD":             "ref: refs/heads/main\n",
+		".gopilot/cache/x.json": "{}",
+	} {
+		writeFile(t, filepath.Join(src, path), content)
+	}
+	if err := os.Symlink("main.go", filepath.Join(src, "link.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyTree(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"main.go", "editor/main/a.gopart"} {
+		if got, want := readFile(t, filepath.Join(dst, path)), readFile(t, filepath.Join(src, path)); got != want {
+			t.Errorf("%s = %q, want %q", path, got, want)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link.go")); err != nil || link != "main.go" {
+		t.Errorf("link.go points to %q (%v), want main.go", link, err)
+	}
+	for _, path := range []string{".git", ".gopilot"} {
+		if _, err := os.Stat(filepath.Join(dst, path)); !os.IsNotExist(err) {
+			t.Errorf("%s was copied", path)
+		}
+	}
+}
+
+func TestEvaluateCandidate(t *testing.T) {
+	const mainGo = "package main\n\nfunc main() {}\n"
+	project := t.TempDir()
+	writeFile(t, filepath.Join(project, "go.mod"), "module example\n\ngo 1.21\n")
+	writeFile(t, filepath.Join(project, "main.go"), mainGo)
+	writeFile(t, filepath.Join(project, "Makefile"), "build:\n\tgo build -o /dev/null .\n")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		content    string
+		wantBuilds bool
+	}{
+		{name: "builds", content: "package main\n\nfunc main() { run() }\n\nfunc run() {}\n", wantBuilds: true},
+		{name: "does not build", content: "package main\n\nfunc main() { run() }\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.NoGopart = true
+			c := &candidate{number: 1, changes: []FileContent{{FilePath: "main.go", Content: tt.content}}}
+
+			evaluateCandidate(context.Background(), config, project, c)
+
+			if c.builds != tt.wantBuilds {
+				t.Errorf("builds = %v, want %v", c.builds, tt.wantBuilds)
+			}
+			if got := readFile(t, filepath.Join(project, "main.go")); got != mainGo {
+				t.Errorf("the project's main.go was changed to %q", got)
+			}
+			if now, _ := os.Getwd(); now != wd {
+				t.Errorf("working directory changed to %s", now)
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A cassette is a recording of every LLM request of a run and what came back,
+// including the individual chunks of streamed responses. Recording one with
+// -record and running again with -replay reproduces the run without calling
+// a model.
+type Cassette struct {
+	mu           sync.Mutex
+	path         string
+	next         int
+	Interactions []Interaction `json:"interactions"`
+}
+
+type Interaction struct {
+	Request  ChatRequest       `json:"request"`
+	Stream   bool              `json:"stream,omitempty"`
+	Response *ChatResponse     `json:"response,omitempty"`
+	Chunks   []ChatStreamChunk `json:"chunks,omitempty"`
+	Usage    Usage             `json:"usage,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+var (
+	cassettes   = map[string]*Cassette{}
+	cassettesMu sync.Mutex
+)
+
+// recordingCassette returns the cassette being recorded to path; all
+// providers of a run share it.
+func recordingCassette(path string) *Cassette {
+	cassettesMu.Lock()
+	defer cassettesMu.Unlock()
+	if c, ok := cassettes[path]; ok {
+		return c
+	}
+	c := &Cassette{path: path}
+	cassettes[path] = c
+	return c
+}
+
+// replayCassette loads the cassette at path once and returns it.
+func replayCassette(path string) *Cassette {
+	cassettesMu.Lock()
+	defer cassettesMu.Unlock()
+	if c, ok := cassettes[path]; ok {
+		return c
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading cassette: %v", err)
+	}
+	c := &Cassette{path: path}
+	if err := json.Unmarshal(content, c); err != nil {
+		log.Fatalf("Error parsing cassette %s: %v", path, err)
+	}
+	cassettes[path] = c
+	return c
+}
+
+// add appends an interaction and writes the cassette, so a run that dies
+// halfway still leaves a usable recording.
+func (c *Cassette) add(interaction Interaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Interactions = append(c.Interactions, interaction)
+
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err == nil {
+		err = os.WriteFile(c.path, content, 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: could not write cassette %s: %v", c.path, err)
+	}
+}
+
+// A replayMismatchError is a request that doesn't match the next one in the
+// cassette. The requests after it can't be replayed either.
+type replayMismatchError struct {
+	path   string
+	n      int // 1-based
+	reason string
+}
+
+func (e *replayMismatchError) Error() string {
+	return fmt.Sprintf("replay: request %d does not match the recording in %s: %s", e.n, e.path, e.reason)
+}
+
+// take returns the next recorded interaction, which must be for the same
+// request. Otherwise the error is a *replayMismatchError.
+func (c *Cassette) take(request ChatRequest, stream bool) (Interaction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.next
+	mismatch := func(format string, args ...any) error {
+		return &replayMismatchError{path: c.path, n: n + 1, reason: fmt.Sprintf(format, args...)}
+	}
+	if n >= len(c.Interactions) {
+		return Interaction{}, mismatch("request to %s was not recorded (the cassette has %d requests)", request.Model, len(c.Interactions))
+	}
+	recorded := c.Interactions[n]
+	if diff := diffRequests(recorded.Request, request); diff != "" {
+		return Interaction{}, mismatch("%s", diff)
+	}
+	if recorded.Stream != stream {
+		return Interaction{}, mismatch("stream is %v, recorded %v", stream, recorded.Stream)
+	}
+	c.next++
+	return recorded, nil
+}
+
+// diffRequests describes the first difference between two requests, or
+// returns "" when they are the same.
+func diffRequests(recorded, actual ChatRequest) string {
+	switch {
+	case recorded.Model != actual.Model:
+		return fmt.Sprintf("model is %q, recorded %q", actual.Model, recorded.Model)
+	case recorded.Temperature != actual.Temperature:
+		return fmt.Sprintf("temperature is %v, recorded %v", actual.Temperature, recorded.Temperature)
+	case recorded.MaxTokens != actual.MaxTokens:
+		return fmt.Sprintf("max tokens is %d, recorded %d", actual.MaxTokens, recorded.MaxTokens)
+	case (recorded.ResponseFormat == nil) != (actual.ResponseFormat == nil):
+		return fmt.Sprintf("response format is set: %v, recorded %v", actual.ResponseFormat != nil, recorded.ResponseFormat != nil)
+	case len(recorded.Tools) != len(actual.Tools):
+		return fmt.Sprintf("%d tools, recorded %d", len(actual.Tools), len(recorded.Tools))
+	case len(recorded.Messages) != len(actual.Messages):
+		return fmt.Sprintf("%d messages, recorded %d", len(actual.Messages), len(recorded.Messages))
+	}
+
+	for i := range recorded.Messages {
+		r, a := recorded.Messages[i], actual.Messages[i]
+		if r.Role != a.Role {
+			return fmt.Sprintf("message %d has role %q, recorded %q", i+1, a.Role, r.Role)
+		}
+		if r.Content == a.Content {
+			continue
+		}
+		recordedLines := strings.Split(r.Content, "\n")
+		actualLines := strings.Split(a.Content, "\n")
+		for l := 0; l < len(recordedLines) && l < len(actualLines); l++ {
+			if recordedLines[l] != actualLines[l] {
+				return fmt.Sprintf("message %d differs at line %d:\n  recorded: %s\n  actual:   %s", i+1, l+1, recordedLines[l], actualLines[l])
+			}
+		}
+		return fmt.Sprintf("message %d has %d lines, recorded %d", i+1, len(actualLines), len(recordedLines))
+	}
+	return ""
+}
+
+// recordingProvider writes every interaction with the provider it wraps to a
+// cassette.
+type recordingProvider struct {
+	Provider
+	cassette *Cassette
+}
+
+func (r *recordingProvider) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	response, err := r.Provider.CreateChatCompletion(ctx, request)
+	interaction := Interaction{Request: request}
+	if err != nil {
+		interaction.Error = err.Error()
+	} else {
+		interaction.Response = &response
+	}
+	r.cassette.add(interaction)
+	return response, err
+}
+
+func (r *recordingProvider) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	stream, err := r.Provider.CreateChatCompletionStream(ctx, request)
+	if err != nil {
+		r.cassette.add(Interaction{Request: request, Stream: true, Error: err.Error()})
+		return nil, err
+	}
+	return &recordingStream{ChatStream: stream, cassette: r.cassette, interaction: Interaction{Request: request, Stream: true}}, nil
+}
+
+type recordingStream struct {
+	ChatStream
+	cassette    *Cassette
+	interaction Interaction
+	done        bool
+}
+
+func (s *recordingStream) Recv() (ChatStreamChunk, error) {
+	chunk, err := s.ChatStream.Recv()
+	if err == nil {
+		s.interaction.Chunks = append(s.interaction.Chunks, chunk)
+		return chunk, nil
+	}
+	if !s.done && !errors.Is(err, io.EOF) {
+		s.interaction.Error = err.Error()
+	}
+	s.finish()
+	return chunk, err
+}
+
+// Close records a stream that was abandoned before its end with the chunks
+// read so far, so a replay sees the same requests as the run.
+func (s *recordingStream) Close() error {
+	s.finish()
+	return s.ChatStream.Close()
+}
+
+// finish adds the interaction to the cassette, the first time it is called.
+func (s *recordingStream) finish() {
+	if s.done {
+		return
+	}
+	s.done = true
+	s.interaction.Usage = s.ChatStream.Usage()
+	s.cassette.add(s.interaction)
+}
+
+// replayProvider serves the interactions of a cassette in order instead of
+// calling a model, and ends the run on any request that doesn't match:
+// callers that carry on past errors (fallbacks, candidates, compaction) would
+// otherwise replay a different run than the one recorded.
+type replayProvider struct {
+	cassette *Cassette
+}
+
+// take is Cassette.take, exiting on a mismatch.
+func (r *replayProvider) take(request ChatRequest, stream bool) Interaction {
+	interaction, err := r.cassette.take(request, stream)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return interaction
+}
+
+func (r *replayProvider) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	interaction := r.take(request, false)
+	if interaction.Error != "" {
+		return ChatResponse{}, errors.New(interaction.Error)
+	}
+	return *interaction.Response, nil
+}
+
+func (r *replayProvider) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	interaction := r.take(request, true)
+	if interaction.Error != "" && len(interaction.Chunks) == 0 {
+		return nil, errors.New(interaction.Error)
+	}
+	return &replayStream{interaction: interaction}, nil
+}
+
+type replayStream struct {
+	interaction Interaction
+	next        int
+}
+
+func (s *replayStream) Recv() (ChatStreamChunk, error) {
+	if s.next < len(s.interaction.Chunks) {
+		chunk := s.interaction.Chunks[s.next]
+		s.next++
+		return chunk, nil
+	}
+	if s.interaction.Error != "" {
+		return ChatStreamChunk{}, errors.New(s.interaction.Error)
+	}
+	return ChatStreamChunk{}, io.EOF
+}
+
+func (s *replayStream) Usage() Usage {
+	return s.interaction.Usage
+}
+
+func (s *replayStream) Close() error {
+	return nil
+}
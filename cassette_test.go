@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffRequests(t *testing.T) {
+	recorded := ChatRequest{
+		Model:       "openai/gpt-4o",
+		Temperature: 0.2,
+		Messages: []ChatMessage{
+			{Role: RoleSystem, Content: "You write Go."},
+			{Role: RoleUser, Content: "first line\nsecond line"},
+		},
+	}
+	with := func(change func(r *ChatRequest)) ChatRequest {
+		r := recorded
+		r.Messages = append([]ChatMessage{}, recorded.Messages...)
+		change(&r)
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		actual ChatRequest
+		want   string
+	}{
+		{"same", with(func(r *ChatRequest) {}), ""},
+		{"model", with(func(r *ChatRequest) { r.Model = "openai/gpt-4o-mini" }), `model is "openai/gpt-4o-mini", recorded "openai/gpt-4o"`},
+		{"temperature", with(func(r *ChatRequest) { r.Temperature = 0.6 }), "temperature is 0.6, recorded 0.2"},
+		{"response format", with(func(r *ChatRequest) { r.ResponseFormat = changesFormat }), "response format is set: true, recorded false"},
+		{"message count", with(func(r *ChatRequest) { r.Messages = r.Messages[:1] }), "1 messages, recorded 2"},
+		{"role", with(func(r *ChatRequest) { r.Messages[0].Role = RoleUser }), `message 1 has role "user", recorded "system"`},
+		{
+			name:   "line",
+			actual: with(func(r *ChatRequest) { r.Messages[1].Content = "first line\nother line" }),
+			want:   "message 2 differs at line 2:\n  recorded: second line\n  actual:   other line",
+		},
+		{"lines added", with(func(r *ChatRequest) { r.Messages[1].Content += "\nthird line" }), "message 2 has 3 lines, recorded 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffRequests(recorded, tt.actual); got != tt.want {
+				t.Errorf("diffRequests() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCassetteTake(t *testing.T) {
+	request := ChatRequest{Model: "openai/gpt-4o", Messages: []ChatMessage{{Role: RoleUser, Content: "hi"}}}
+	cassette := &Cassette{path: "run.json", Interactions: []Interaction{
+		{Request: request, Response: &ChatResponse{Content: "hello"}},
+	}}
+
+	var mismatch *replayMismatchError
+	if _, err := cassette.take(request, true); !errors.As(err, &mismatch) {
+		t.Errorf("take() with another stream setting = %v, want a mismatch", err)
+	}
+	interaction, err := cassette.take(request, false)
+	if err != nil || interaction.Response.Content != "hello" {
+		t.Errorf("take() = %+v, %v, want the recorded interaction", interaction, err)
+	}
+	if _, err := cassette.take(request, false); !errors.As(err, &mismatch) || mismatch.n != 2 {
+		t.Errorf("take() past the end = %v, want a mismatch of request 2", err)
+	}
+}
+
+func TestRecordingStreamRecordsOnce(t *testing.T) {
+	chunks := []ChatStreamChunk{{Content: "one "}, {Content: "two "}, {Content: "three", FinishReason: "stop"}}
+	tests := []struct {
+		name   string
+		reads  int // Recv calls before Close
+		chunks int // recorded
+		err    error
+	}{
+		{"drained", 5, 3, nil},
+		{"abandoned", 1, 1, nil},
+		{"closed unread", 0, 0, nil},
+		{"failed", 5, 3, errors.New("connection reset")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cassette := &Cassette{path: filepath.Join(t.TempDir(), "run.json")}
+			stream := &recordingStream{
+				ChatStream:  &fakeStream{chunks: append([]ChatStreamChunk{}, chunks...), err: tt.err},
+				cassette:    cassette,
+				interaction: Interaction{Request: ChatRequest{Model: "fake"}, Stream: true},
+			}
+			for i := 0; i < tt.reads; i++ {
+				stream.Recv()
+			}
+			stream.Close()
+			stream.Close()
+
+			if len(cassette.Interactions) != 1 {
+				t.Fatalf("recorded %d interactions, want 1", len(cassette.Interactions))
+			}
+			recorded := cassette.Interactions[0]
+			if len(recorded.Chunks) != tt.chunks {
+				t.Errorf("recorded %d chunks, want %d", len(recorded.Chunks), tt.chunks)
+			}
+			want := ""
+			if tt.err != nil {
+				want = tt.err.Error()
+			}
+			if recorded.Error != want {
+				t.Errorf("recorded error %q, want %q", recorded.Error, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// conventionsFile describes how the project wants its code written. It is
+// part of every changes prompt, including those for fixing the build and the
+// tests.
+var conventionsFile = filepath.Join(".gopilot", "CONVENTIONS.md")
+
+// opinions are the rules of the built-in prompts that not every project
+// shares. Prompts check them with {{if opinion "name"}}.
+var opinions = map[string]string{
+	"emoji":           "use emoji in Markdown files",
+	"no-ioutil":       "avoid the deprecated io/ioutil package",
+	"docs-match-code": "when editing docs, change the docs to match the code and not the other way around",
+}
+
+// disabledOpinions are turned off with -disable-opinions.
+var disabledOpinions = map[string]bool{}
+
+func readConventions() string {
+	content, err := os.ReadFile(conventionsFile)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", conventionsFile, err)
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// addConventions puts the conventions of the project in a system message of
+// their own, for changes prompts that don't place them with {{.Conventions}}.
+func addConventions(messages []ChatMessage, fields map[string]bool) []ChatMessage {
+	if fields["Conventions"] {
+		return messages
+	}
+	conventions := readConventions()
+	if conventions == "" {
+		return messages
+	}
+	return insertSystemMessage(messages, "Follow the conventions of this project:\n\n"+conventions)
+}
+
+// parseDisabledOpinions reads a comma separated list of opinion names.
+func parseDisabledOpinions(s string) {
+	for _, name := range splitList(s) {
+		if _, ok := opinions[name]; !ok {
+			log.Fatalf("Unknown opinion %q, use one of %s", name, strings.Join(opinionNames(), ", "))
+		}
+		disabledOpinions[name] = true
+	}
+}
+
+func opinionNames() []string {
+	var names []string
+	for name := range opinions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// opinion is the template function telling whether an opinion is on.
+func opinion(name string) (bool, error) {
+	if _, ok := opinions[name]; !ok {
+		return false, fmt.Errorf("unknown opinion %q", name)
+	}
+	return !disabledOpinions[name], nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// useDisabledOpinions turns off the opinions in list for the test.
+func useDisabledOpinions(t *testing.T, list string) {
+	saved := disabledOpinions
+	t.Cleanup(func() { disabledOpinions = saved })
+	disabledOpinions = map[string]bool{}
+	parseDisabledOpinions(list)
+}
+
+func TestOpinion(t *testing.T) {
+	tests := []struct {
+		name     string
+		disabled string
+		opinion  string
+		want     bool
+		wantErr  bool
+	}{
+		{name: "on by default", opinion: "emoji", want: true},
+		{name: "disabled", disabled: "emoji", opinion: "emoji", want: false},
+		{name: "another one disabled", disabled: "emoji", opinion: "no-ioutil", want: true},
+		{name: "list with spaces", disabled: " no-ioutil , docs-match-code ", opinion: "docs-match-code", want: false},
+		{name: "unknown", opinion: "tabs", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useDisabledOpinions(t, tt.disabled)
+			got, err := opinion(tt.opinion)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("opinion(%q) error = %v, want error %v", tt.opinion, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("opinion(%q) = %v, want %v", tt.opinion, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDisableOpinions checks that each opinion can be taken out of the
+// changes prompts.
+func TestDisableOpinions(t *testing.T) {
+	texts := map[string]string{
+		"emoji":           "emoji",
+		"no-ioutil":       "ioutil",
+		"docs-match-code": "you match the md file to the code",
+	}
+	for _, name := range []string{"changes_goparts.txt", "changes_no_goparts.txt"} {
+		content, err := promptFS.ReadFile("prompts/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl, err := parsePromptTemplate(name, string(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, opinion := range opinionNames() {
+			text, ok := texts[opinion]
+			if !ok {
+				t.Fatalf("no text to look for in the prompts for opinion %s", opinion)
+			}
+			for _, disabled := range []string{"", opinion} {
+				useDisabledOpinions(t, disabled)
+				prompt, err := tmpl.text(map[string]any{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := strings.Contains(prompt, text), disabled == ""; got != want {
+					t.Errorf("%s with -disable-opinions=%q contains %q: %v, want %v", name, disabled, text, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHistoryTokens = 16000
+	// historyShare is the part of the context budget, one in so many, the
+	// conversation may take from the project files
+	historyShare = 4
+	// turnOutputLines is how much build output a turn keeps
+	turnOutputLines = 30
+)
+
+// A Conversation is the thread of prompts on a gopilot branch and what came
+// of them. Later prompts on the branch continue it, so the model knows what
+// it did before. Turns that no longer fit are folded into Summary.
+type Conversation struct {
+	Branch  string `json:"branch"`
+	Summary string `json:"summary,omitempty"`
+	Turns   []Turn `json:"turns"`
+}
+
+// A Turn is kept short: the model's reply is left out, as the files it
+// changed are sent as they are now, and a repair is kept as what it was for,
+// as its errors are in the build output of the turn before.
+type Turn struct {
+	Time        time.Time `json:"time"`
+	Prompt      string    `json:"prompt"`
+	Changes     []string  `json:"changes,omitempty"`
+	Build       string    `json:"build,omitempty"` // "succeeded" or "failed"
+	BuildOutput string    `json:"build_output,omitempty"`
+}
+
+// currentConversation is the conversation of the branch gopilot works on, or
+// nil when there is none.
+var currentConversation *Conversation
+
+func conversationPath(branch string) string {
+	return filepath.Join(gopilotDir("conversations"), url.PathEscape(branch)+".json")
+}
+
+// loadConversation returns the conversation of branch, or nil if the branch
+// has none.
+func loadConversation(branch string) *Conversation {
+	content, err := os.ReadFile(conversationPath(branch))
+	if err != nil {
+		return nil
+	}
+	var c Conversation
+	if err := json.Unmarshal(content, &c); err != nil {
+		log.Printf("Warning: ignoring unreadable conversation for branch %s: %v", branch, err)
+		return nil
+	}
+	return &c
+}
+
+func deleteConversation(branch string) {
+	os.Remove(conversationPath(branch))
+}
+
+func (c *Conversation) save() {
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err == nil {
+		err = os.WriteFile(conversationPath(c.Branch), content, 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: could not save conversation: %v", err)
+	}
+}
+
+// turnPrompt is the prompt of config as a turn keeps it.
+func turnPrompt(config Config) string {
+	switch config.Task {
+	case taskBuildRepair:
+		return "Fix the build errors."
+	case taskTestRepair:
+		return "Fix the failing tests."
+	}
+	return config.Prompt
+}
+
+// addTurn records a prompt and the changes made for it.
+func (c *Conversation) addTurn(prompt string, changes []FileContent) {
+	if c == nil {
+		return
+	}
+	turn := Turn{Time: time.Now(), Prompt: prompt}
+	for _, change := range changes {
+		if change.Delete {
+			turn.Changes = append(turn.Changes, change.FilePath+" (deleted)")
+		} else {
+			turn.Changes = append(turn.Changes, change.FilePath)
+		}
+	}
+	c.Turns = append(c.Turns, turn)
+	c.save()
+}
+
+// addBuildResult records how the build went after the last turn.
+func (c *Conversation) addBuildResult(succeeded bool, output string) {
+	if c == nil || len(c.Turns) == 0 {
+		return
+	}
+	turn := &c.Turns[len(c.Turns)-1]
+	turn.Build = "failed"
+	if succeeded {
+		turn.Build = "succeeded"
+	}
+	turn.BuildOutput = lastLines(output, turnOutputLines)
+	c.save()
+}
+
+// lastLines returns the last n lines of s, where build errors end up.
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) <= n {
+		return strings.TrimRight(s, "\n")
+	}
+	return fmt.Sprintf("(%d lines left out)\n%s", len(lines)-n, strings.Join(lines[len(lines)-n:], "\n"))
+}
+
+// reply describes what the model did in a turn.
+func (t Turn) reply() string {
+	if len(t.Changes) == 0 {
+		return "No changes."
+	}
+	return fmt.Sprintf("Changed %s.", strings.Join(t.Changes, ", "))
+}
+
+// outcome describes how the build went after a turn, as the user would
+// report it, or is empty when it wasn't built.
+func (t Turn) outcome() string {
+	if t.Build == "" {
+		return ""
+	}
+	outcome := fmt.Sprintf("The build %s.", t.Build)
+	if t.BuildOutput != "" {
+		outcome += "\n" + t.BuildOutput
+	}
+	return outcome
+}
+
+// turnMessages returns the messages of turns.
+func turnMessages(turns []Turn) []ChatMessage {
+	var messages []ChatMessage
+	for _, turn := range turns {
+		messages = append(messages,
+			ChatMessage{Role: RoleUser, Content: turn.Prompt},
+			ChatMessage{Role: RoleAssistant, Content: turn.reply()},
+		)
+		if outcome := turn.outcome(); outcome != "" {
+			messages = append(messages, ChatMessage{Role: RoleUser, Content: outcome})
+		}
+	}
+	return messages
+}
+
+// messages returns the conversation so far as chat messages, to go before
+// the new prompt, in at most maxTokens of model: while it takes more, the
+// oldest turns are left out, then the summary and then the last turn.
+func (c *Conversation) messages(model string, maxTokens int) []ChatMessage {
+	if c == nil {
+		return nil
+	}
+	var summary []ChatMessage
+	if c.Summary != "" {
+		summary = []ChatMessage{{Role: RoleSystem, Content: "Summary of the earlier conversation on this branch:\n" + c.Summary}}
+	}
+	turns := c.Turns
+	for {
+		messages := append(append([]ChatMessage(nil), summary...), turnMessages(turns)...)
+		if len(messages) == 0 || countMessageTokens(model, messages) <= maxTokens {
+			if len(turns) < len(c.Turns) || summary == nil && c.Summary != "" {
+				fmt.Printf("Leaving out the oldest part of the conversation, which doesn't fit in %d tokens\n", maxTokens)
+			}
+			return messages
+		}
+		switch {
+		case len(turns) > 1:
+			turns = turns[1:]
+		case summary != nil:
+			summary = nil
+		default:
+			turns = nil
+		}
+	}
+}
+
+func (c *Conversation) transcript(turns []Turn) string {
+	var transcript strings.Builder
+	for _, turn := range turns {
+		fmt.Fprintf(&transcript, "User: %s\n\nAssistant: %s\n\n", turn.Prompt, turn.reply())
+		if outcome := turn.outcome(); outcome != "" {
+			fmt.Fprintf(&transcript, "Result: %s\n\n", outcome)
+		}
+	}
+	return transcript.String()
+}
+
+// compact folds all but the last turn into the summary once the
+// conversation takes more than maxTokens, using the low model. When that
+// fails the conversation is sent in full, unless the budget ran out.
+func (c *Conversation) compact(ctx context.Context, config Config, maxTokens int) error {
+	if c == nil || len(c.Turns) < 2 || countMessageTokens(config.OrHigh, c.messages(config.OrHigh, math.MaxInt)) <= maxTokens {
+		return nil
+	}
+	fmt.Println("Summarizing the conversation on branch", c.Branch)
+
+	old := c.Turns[:len(c.Turns)-1]
+	tmpl, err := parsePromptTemplate("summary", getPromptContent("", "prompts/summarize_conversation.txt"))
+	if err != nil {
+		log.Fatal(err, "in compact: template parsing")
+	}
+	messages, err := tmpl.messages(promptData(ctx, tmpl.fields(), map[string]string{
+		"ProjectName": config.ProjectName,
+		"Branch":      c.Branch,
+		"Summary":     c.Summary,
+		"Turns":       c.transcript(old),
+	}), nil)
+	if err != nil {
+		log.Fatal(err, "in compact: template execution")
+	}
+
+	resp, err := complete(ctx, createProvider(config), config, roleLow, messages)
+	if err != nil {
+		exitIfInterrupted(ctx)
+		if errors.Is(err, ErrBudgetExceeded) {
+			return err
+		}
+		log.Printf("Warning: could not summarize the conversation, sending it in full: %v", err)
+		return nil
+	}
+
+	c.Summary = strings.TrimSpace(resp.Content)
+	c.Turns = append([]Turn{}, c.Turns[len(c.Turns)-1:]...)
+	c.save()
+	return nil
+}
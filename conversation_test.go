@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConversationMessages(t *testing.T) {
+	c := &Conversation{
+		Summary: "Added retries.",
+		Turns: []Turn{
+			{Prompt: "Add a timeout", Changes: []string{"client.go"}, Build: "failed", BuildOutput: "client.go:3: undefined: time"},
+			{Prompt: "Fix the build errors.", Changes: []string{"client.go"}, Build: "succeeded"},
+			{Prompt: "Remove the old client", Changes: []string{"old.go (deleted)"}},
+		},
+	}
+	summary := ChatMessage{Role: RoleSystem, Content: "Summary of the earlier conversation on this branch:\nAdded retries."}
+	first := []ChatMessage{
+		{Role: RoleUser, Content: "Add a timeout"},
+		{Role: RoleAssistant, Content: "Changed client.go."},
+		{Role: RoleUser, Content: "The build failed.\nclient.go:3: undefined: time"},
+	}
+	second := []ChatMessage{
+		{Role: RoleUser, Content: "Fix the build errors."},
+		{Role: RoleAssistant, Content: "Changed client.go."},
+		{Role: RoleUser, Content: "The build succeeded."},
+	}
+	last := []ChatMessage{
+		{Role: RoleUser, Content: "Remove the old client"},
+		{Role: RoleAssistant, Content: "Changed old.go (deleted)."},
+	}
+	join := func(parts ...[]ChatMessage) []ChatMessage {
+		var messages []ChatMessage
+		for _, part := range parts {
+			messages = append(messages, part...)
+		}
+		return messages
+	}
+	all := join([]ChatMessage{summary}, first, second, last)
+	tokens := func(messages []ChatMessage) int { return countMessageTokens("fake", messages) }
+
+	tests := []struct {
+		name      string
+		maxTokens int
+		want      []ChatMessage
+	}{
+		{"everything fits", math.MaxInt, all},
+		{"oldest turn left out", tokens(join([]ChatMessage{summary}, second, last)), join([]ChatMessage{summary}, second, last)},
+		{"only the summary and the last turn", tokens(join([]ChatMessage{summary}, last)), join([]ChatMessage{summary}, last)},
+		{"summary too long", tokens(last), last},
+		{"nothing fits", 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.messages("fake", tt.maxTokens); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTurnPrompt(t *testing.T) {
+	tests := []struct {
+		task string
+		want string
+	}{
+		{"", "Add a timeout"},
+		{taskSmallFix, "Add a timeout"},
+		{taskBuildRepair, "Fix the build errors."},
+		{taskTestRepair, "Fix the failing tests."},
+	}
+	for _, tt := range tests {
+		if got := turnPrompt(Config{Prompt: "Add a timeout", Task: tt.task}); got != tt.want {
+			t.Errorf("turnPrompt() for task %q = %q, want %q", tt.task, got, tt.want)
+		}
+	}
+}
+
+func TestLastLines(t *testing.T) {
+	long := strings.Repeat("line\n", 5) + "error: last\n"
+	tests := []struct {
+		name   string
+		output string
+		n      int
+		want   string
+	}{
+		{"short", "error: one\n", 3, "error: one"},
+		{"exactly n", "a\nb\nc\n", 3, "a\nb\nc"},
+		{"long", long, 2, "(4 lines left out)\nline\nerror: last"},
+		{"empty", "", 3, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lastLines(tt.output, tt.n); got != tt.want {
+				t.Errorf("lastLines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+const (
+	roleHigh = "high"
+	roleLow  = "low"
+
+	defaultFallbackOn = "error,length,invalid-json"
+)
+
+// FallbackConfig lists the models to try, in order, when the configured
+// model of a role fails, and on which failures to move on.
+type FallbackConfig struct {
+	High          []string
+	Low           []string
+	OnError       bool
+	OnLength      bool
+	OnInvalidJSON bool
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// parseFallbackOn reads a comma separated list of error, length and
+// invalid-json.
+func parseFallbackOn(fallback *FallbackConfig, s string) {
+	for _, rule := range splitList(s) {
+		switch rule {
+		case "error":
+			fallback.OnError = true
+		case "length":
+			fallback.OnLength = true
+		case "invalid-json":
+			fallback.OnInvalidJSON = true
+		default:
+			log.Fatalf("Unknown fallback rule %q, use error, length or invalid-json", rule)
+		}
+	}
+}
+
+// modelChain returns the model for role followed by its fallbacks.
+func modelChain(config Config, role string) []string {
+	if role == roleLow {
+		return append([]string{config.OrLow}, config.Fallback.Low...)
+	}
+	return append([]string{config.OrHigh}, config.Fallback.High...)
+}
+
+// fallBack reports whether the next model should be tried after models[i]
+// failed for reason.
+func fallBack(models []string, i int, enabled bool, reason string) bool {
+	if !enabled || i == len(models)-1 {
+		return false
+	}
+	fmt.Printf("\n%s %s, falling back to %s\n", models[i], reason, models[i+1])
+	return true
+}
+
+// complete asks the models of role in turn until one gives a usable answer.
+func complete(ctx context.Context, client Provider, config Config, role string, messages []ChatMessage) (ChatResponse, error) {
+	return completeRequest(ctx, client, config, modelChain(config, role), ChatRequest{Messages: messages})
+}
+
+// completeRequest is complete for a request with more than messages, asking
+// models in turn. Its Model is set to each model tried.
+func completeRequest(ctx context.Context, client Provider, config Config, models []string, request ChatRequest) (ChatResponse, error) {
+	var response ChatResponse
+	var err error
+
+	for i, model := range models {
+		request.Model = model
+		response, err = client.CreateChatCompletion(ctx, request)
+		if err != nil {
+			if errors.Is(err, ErrBudgetExceeded) || !fallBack(models, i, config.Fallback.OnError, fmt.Sprintf("failed (%v)", err)) {
+				return response, err
+			}
+			continue
+		}
+		if response.FinishReason == "length" && fallBack(models, i, config.Fallback.OnLength, "ran out of tokens") {
+			continue
+		}
+		if strings.TrimSpace(response.Content) == "" && len(response.ToolCalls) == 0 && fallBack(models, i, config.Fallback.OnError, "returned nothing") {
+			continue
+		}
+		break
+	}
+	return response, err
+}
+
+// streamCompletion streams a completion to stdout and returns the complete
+// response, including the tool calls the model made.
+func streamCompletion(ctx context.Context, client Provider, request ChatRequest) (ChatResponse, error) {
+	response := ChatResponse{Model: request.Model}
+	stream, err := client.CreateChatCompletionStream(ctx, request)
+	if err != nil {
+		return response, err
+	}
+	defer stream.Close()
+
+	var fullResponse strings.Builder
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			response.Content = fullResponse.String()
+			return response, err
+		}
+		if chunk.Reset {
+			fmt.Println("\nStream restarted, discarding partial response.")
+			fullResponse.Reset()
+			response.ToolCalls = nil
+			continue
+		}
+		if chunk.FinishReason != "" {
+			response.FinishReason = chunk.FinishReason
+		}
+		fullResponse.WriteString(chunk.Content)
+		fmt.Print(chunk.Content)
+		for _, call := range chunk.ToolCalls {
+			if call.Name != "" {
+				fmt.Printf("\n%s: ", call.Name)
+			}
+			fmt.Print(call.Arguments)
+		}
+		response.ToolCalls = addToolCalls(response.ToolCalls, chunk.ToolCalls)
+	}
+	response.Content = fullResponse.String()
+	response.Usage = stream.Usage()
+	return response, nil
+}
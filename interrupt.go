@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// untrackedMaxSize is the largest untracked file a snapshot keeps a copy of.
+const untrackedMaxSize = 1 << 20
+
+// A snapshot is the state of the repository at the start of a run: the
+// branch, its HEAD, uncommitted changes and untracked files. Ctrl-C during
+// the run puts it back.
+type snapshot struct {
+	branch       string
+	detached     bool // HEAD was not on a branch; branch is then "HEAD"
+	head         string
+	stash        string            // commit with the uncommitted changes, "" when there were none
+	mainHead     string            // HEAD of main before merging into it, "" until then
+	untracked    map[string][]byte // untracked files and, if small enough, their content
+	branches     map[string]bool
+	conversation []byte
+}
+
+// runSnapshot is restored by exitIfInterrupted; nil before a run starts.
+var runSnapshot *snapshot
+
+// git runs a git command for taking or restoring a snapshot. These must not
+// use the run's context, which is cancelled by the time we restore.
+func git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func untrackedFiles() []string {
+	out, err := git("ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	return strings.FieldsFunc(out, func(r rune) bool { return r == 0 })
+}
+
+func localBranches() map[string]bool {
+	branches := map[string]bool{}
+	out, _ := git("for-each-ref", "--format=%(refname:short)", "refs/heads")
+	for _, branch := range strings.Fields(out) {
+		branches[branch] = true
+	}
+	return branches
+}
+
+func takeSnapshot() *snapshot {
+	s := &snapshot{
+		branch:    getCurrentBranch(),
+		untracked: map[string][]byte{},
+		branches:  localBranches(),
+	}
+	s.detached = s.branch == "HEAD"
+	// HEAD doesn't exist yet in a repository without commits
+	s.head, _ = git("rev-parse", "HEAD")
+	stash, err := git("stash", "create")
+	if err != nil {
+		log.Printf("Warning: uncommitted changes can't be restored on Ctrl-C: %v", err)
+	}
+	s.stash = stash
+
+	var large []string
+	for _, path := range untrackedFiles() {
+		s.untracked[path] = nil
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.Size() > untrackedMaxSize {
+			large = append(large, path)
+			continue
+		}
+		s.untracked[path], _ = os.ReadFile(path)
+	}
+	if len(large) > 0 {
+		log.Printf("Warning: untracked files over %d MB can't be restored on Ctrl-C if the run changes them: %s", untrackedMaxSize>>20, strings.Join(large, ", "))
+	}
+	// a detached HEAD has no conversation
+	if !s.detached {
+		s.conversation, _ = os.ReadFile(conversationPath(s.branch))
+	}
+	return s
+}
+
+// restore puts the repository back the way it was when the snapshot was
+// taken. It carries on past errors to restore as much as it can.
+func (s *snapshot) restore() {
+	warn := func(err error) {
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	// -B brings back the branch when it was merged and deleted
+	switch {
+	case s.detached:
+		warn(gitRun("checkout", "-f", "--detach", s.head))
+	case s.head != "":
+		warn(gitRun("checkout", "-f", "-B", s.branch, s.head))
+	default:
+		warn(gitRun("checkout", "-f", s.branch))
+	}
+	if s.mainHead != "" && s.branch != "main" {
+		warn(gitRun("update-ref", "refs/heads/main", s.mainHead))
+	}
+	if s.stash != "" {
+		if gitRun("stash", "apply", "--index", s.stash) != nil {
+			warn(gitRun("stash", "apply", s.stash))
+		}
+	}
+
+	for _, path := range untrackedFiles() {
+		content, existed := s.untracked[path]
+		switch {
+		case !existed:
+			warn(os.Remove(path))
+			removeEmptyDirs(filepath.Dir(path))
+		case content != nil:
+			warn(os.WriteFile(path, content, 0644))
+		}
+	}
+	// untracked files removed during the run
+	for path, content := range s.untracked {
+		if _, err := os.Stat(path); os.IsNotExist(err) && content != nil {
+			os.MkdirAll(filepath.Dir(path), 0755)
+			warn(os.WriteFile(path, content, 0644))
+		}
+	}
+
+	for branch := range localBranches() {
+		if !s.branches[branch] {
+			warn(gitRun("branch", "-D", branch))
+			deleteConversation(branch)
+			fmt.Println("Deleted branch", branch)
+		}
+	}
+
+	switch {
+	case s.detached:
+		// a detached HEAD has no conversation
+	case s.conversation != nil:
+		warn(os.WriteFile(conversationPath(s.branch), s.conversation, 0644))
+	default:
+		deleteConversation(s.branch)
+	}
+}
+
+func gitRun(args ...string) error {
+	_, err := git(args...)
+	return err
+}
+
+// removeEmptyDirs removes dir and its parents as long as they are empty.
+func removeEmptyDirs(dir string) {
+	for dir != "." && dir != "/" && os.Remove(dir) == nil {
+		dir = filepath.Dir(dir)
+	}
+}
+
+type removeOnInterruptKey struct{}
+
+// removeOnInterrupt returns ctx, with dir to be removed by exitIfInterrupted
+// when called with it: os.Exit skips deferred calls.
+func removeOnInterrupt(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, removeOnInterruptKey{}, dir)
+}
+
+// exitIfInterrupted restores the repository and exits when the run was
+// interrupted. It is called wherever a cancelled context shows up, so
+// nothing is left half done.
+func exitIfInterrupted(ctx context.Context) {
+	if ctx.Err() == nil {
+		return
+	}
+
+	fmt.Println("\nInterrupted.")
+	if runSnapshot != nil {
+		runSnapshot.restore()
+		if runSnapshot.detached {
+			fmt.Printf("Restored the detached HEAD at %s.\n", runSnapshot.head)
+		} else {
+			fmt.Printf("Restored branch %s to where it was before the run.\n", runSnapshot.branch)
+		}
+	}
+	if dir, ok := ctx.Value(removeOnInterruptKey{}).(string); ok {
+		os.RemoveAll(dir)
+	}
+	printSessionSummary()
+	os.Exit(130)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRepo makes a git repository with one commit on main in a temporary
+// directory and changes into it for the rest of the test.
+func testRepo(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	wd, _ := os.Getwd()
+	t.Cleanup(func() { os.Chdir(wd) })
+	os.Chdir(t.TempDir())
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "test")
+	}
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "test@example.com")
+	}
+
+	mustGit(t, "init", "-q", "-b", "main")
+	writeFile(t, "main.go", "package main\n")
+	mustGit(t, "add", "main.go")
+	mustGit(t, "commit", "-q", "-m", "initial")
+}
+
+func mustGit(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := git(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	testRepo(t)
+	writeFile(t, "main.go", "package main\n\n// uncommitted\n")
+	writeFile(t, "notes.txt", "untracked\n")
+	head := mustGit(t, "rev-parse", "HEAD")
+
+	s := takeSnapshot()
+
+	// what a run does: a branch with a commit, split files, a changed
+	// untracked file
+	mustGit(t, "checkout", "-q", "-b", "gopilot/feature")
+	writeFile(t, "main.go", "package main\n\nfunc feature() {}\n")
+	mustGit(t, "commit", "-q", "-am", "feature")
+	writeFile(t, "editor/main.go/imports.gopart", "package main\n")
+	writeFile(t, "notes.txt", "changed\n")
+
+	s.restore()
+
+	if branch := getCurrentBranch(); branch != "main" {
+		t.Errorf("on branch %s, want main", branch)
+	}
+	if got := mustGit(t, "rev-parse", "HEAD"); got != head {
+		t.Errorf("HEAD = %s, want %s", got, head)
+	}
+	if got := readFile(t, "main.go"); got != "package main\n\n// uncommitted\n" {
+		t.Errorf("main.go = %q, want the uncommitted change", got)
+	}
+	if got := readFile(t, "notes.txt"); got != "untracked\n" {
+		t.Errorf("notes.txt = %q, want its content before the run", got)
+	}
+	if _, err := os.Stat("editor"); !os.IsNotExist(err) {
+		t.Error("the split files were not removed")
+	}
+	if localBranches()["gopilot/feature"] {
+		t.Error("the branch of the run was not deleted")
+	}
+}
+
+func TestSnapshotRestoreDetached(t *testing.T) {
+	testRepo(t)
+	head := mustGit(t, "rev-parse", "HEAD")
+	mustGit(t, "checkout", "-q", "--detach")
+
+	s := takeSnapshot()
+	if !s.detached {
+		t.Fatal("snapshot of a detached HEAD is not marked detached")
+	}
+
+	mustGit(t, "checkout", "-q", "-b", "gopilot/feature")
+	writeFile(t, "main.go", "package main\n\nfunc feature() {}\n")
+	mustGit(t, "commit", "-q", "-am", "feature")
+
+	s.restore()
+
+	if branch := getCurrentBranch(); branch != "HEAD" {
+		t.Errorf("on branch %s, want a detached HEAD", branch)
+	}
+	if got := mustGit(t, "rev-parse", "HEAD"); got != head {
+		t.Errorf("HEAD = %s, want %s", got, head)
+	}
+	if branches := localBranches(); len(branches) != 1 || !branches["main"] {
+		t.Errorf("branches = %v, want only main", branches)
+	}
+}
+
+func TestSnapshotWarnsAboutLargeUntrackedFiles(t *testing.T) {
+	testRepo(t)
+	writeFile(t, "small.txt", "small\n")
+	writeFile(t, "large.bin", strings.Repeat("x", untrackedMaxSize+1))
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	s := takeSnapshot()
+
+	if !strings.Contains(logged.String(), "large.bin") || strings.Contains(logged.String(), "small.txt") {
+		t.Errorf("logged %q, want a warning about large.bin only", logged.String())
+	}
+	if s.untracked["large.bin"] != nil || s.untracked["small.txt"] == nil {
+		t.Error("want a copy of small.txt only")
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalClient is the Provider for a model server on the local machine. It
+// speaks the native Ollama API when that is available and falls back to the
+// OpenAI compatible endpoint of llama.cpp's server otherwise.
+type LocalClient struct {
+	baseURL    string
+	flavor     string // "ollama" or "llamacpp"
+	httpClient *http.Client
+}
+
+type localModel struct {
+	Name string
+	Size int64
+}
+
+// ollamaMessage and llamaCppMessage have no tool calls: -tool-mode is not
+// supported with the local provider.
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Format   json.RawMessage `json:"format,omitempty"` // JSON schema of the reply
+	Options  map[string]any  `json:"options,omitempty"`
+}
+
+type ollamaResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+type llamaCppMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type llamaCppRequest struct {
+	Model          string            `json:"model,omitempty"`
+	Messages       []llamaCppMessage `json:"messages"`
+	Stream         bool              `json:"stream"`
+	Temperature    float32           `json:"temperature,omitempty"`
+	MaxTokens      int               `json:"max_tokens,omitempty"`
+	ResponseFormat map[string]any    `json:"response_format,omitempty"` // OpenAI style, with a JSON schema
+	CachePrompt    bool              `json:"cache_prompt,omitempty"`    // reuse the KV cache of the common prefix
+}
+
+// llamaCppResponse is used for both complete responses and stream chunks.
+// llama.cpp only sometimes includes usage; timings are always there.
+type llamaCppResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      llamaCppMessage `json:"message"`
+		Delta        llamaCppMessage `json:"delta"`
+		FinishReason string          `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	Timings *struct {
+		PromptN    int `json:"prompt_n"`
+		PredictedN int `json:"predicted_n"`
+	} `json:"timings"`
+}
+
+type localStream struct {
+	body   io.ReadCloser
+	flavor string
+	lines  *bufio.Scanner
+	events *sseReader
+	usage  Usage
+	done   bool
+}
+
+func newLocalClient(config Config) *LocalClient {
+	baseURL, flavor := detectLocalServer(config.OrBase)
+	return &LocalClient{
+		baseURL:    baseURL,
+		flavor:     flavor,
+		httpClient: &http.Client{},
+	}
+}
+
+var (
+	localFlavors   = map[string]string{} // by root URL
+	localFlavorsMu sync.Mutex
+)
+
+// detectLocalServer probes the server behind base and returns the root URL
+// and which API it speaks. The probe is done once per server: every request
+// makes a new provider.
+func detectLocalServer(base string) (string, string) {
+	baseURL := strings.TrimSuffix(strings.TrimSuffix(base, "/"), "/v1")
+	localFlavorsMu.Lock()
+	defer localFlavorsMu.Unlock()
+	if flavor, ok := localFlavors[baseURL]; ok {
+		return baseURL, flavor
+	}
+
+	flavor := "llamacpp"
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(baseURL + "/api/tags")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			flavor = "ollama"
+		}
+	}
+	localFlavors[baseURL] = flavor
+	return baseURL, flavor
+}
+
+// listLocalModels returns the models the local server has available.
+func listLocalModels(base string) ([]localModel, error) {
+	baseURL, flavor := detectLocalServer(base)
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	if flavor == "ollama" {
+		resp, err := client.Get(baseURL + "/api/tags")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		var tags struct {
+			Models []struct {
+				Name string `json:"name"`
+				Size int64  `json:"size"`
+			} `json:"models"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+			return nil, fmt.Errorf("decoding ollama model list: %w", err)
+		}
+
+		var models []localModel
+		for _, m := range tags.Models {
+			models = append(models, localModel{Name: m.Name, Size: m.Size})
+		}
+		return models, nil
+	}
+
+	resp, err := client.Get(baseURL + "/v1/models")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing models: status %d", resp.StatusCode)
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("decoding model list: %w", err)
+	}
+
+	var models []localModel
+	for _, m := range list.Data {
+		models = append(models, localModel{Name: m.ID})
+	}
+	return models, nil
+}
+
+// resolveLocalModels maps OR_LOW and OR_HIGH onto models the local server
+// actually has. Models that are configured and available are kept; otherwise
+// the smallest model is used for low and the largest for high.
+func resolveLocalModels(config Config) (string, string) {
+	models, err := listLocalModels(config.OrBase)
+	if err != nil {
+		log.Fatalf("Error listing models on local server %s: %v", config.OrBase, err)
+	}
+	if len(models) == 0 {
+		log.Fatalf("Local server %s has no models available", config.OrBase)
+	}
+
+	sort.SliceStable(models, func(i, j int) bool {
+		return models[i].Size < models[j].Size
+	})
+
+	pick := func(wanted, role string, fallback localModel) string {
+		for _, m := range models {
+			if m.Name == wanted || strings.TrimSuffix(m.Name, ":latest") == wanted {
+				return m.Name
+			}
+		}
+		if wanted != "" {
+			log.Printf("Warning: %s model %s is not available on the local server, using %s", role, wanted, fallback.Name)
+		}
+		return fallback.Name
+	}
+
+	low := pick(config.OrLow, "low", models[0])
+	high := pick(config.OrHigh, "high", models[len(models)-1])
+	fmt.Printf("Using local models: low=%s high=%s\n", low, high)
+	return low, high
+}
+
+// SupportsPrefill is true for Ollama, which continues a trailing assistant
+// message; llama.cpp's chat endpoint does not reliably do so.
+func (l *LocalClient) SupportsPrefill() bool {
+	return l.flavor == "ollama"
+}
+
+func (l *LocalClient) post(ctx context.Context, path string, payload any) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		content, _ := io.ReadAll(resp.Body)
+		return nil, &ProviderError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			Err:        fmt.Errorf("%s: status %d: %s", l.flavor, resp.StatusCode, strings.TrimSpace(string(content))),
+		}
+	}
+	return resp, nil
+}
+
+func (l *LocalClient) ollamaRequest(request ChatRequest, stream bool) ollamaRequest {
+	result := ollamaRequest{Model: request.Model, Stream: stream, Options: map[string]any{}}
+	for _, m := range request.Messages {
+		result.Messages = append(result.Messages, ollamaMessage{Role: m.Role, Content: m.Content})
+	}
+	if request.Temperature != 0 {
+		result.Options["temperature"] = request.Temperature
+	}
+	if request.MaxTokens != 0 {
+		result.Options["num_predict"] = request.MaxTokens
+	}
+	if request.ResponseFormat != nil {
+		result.Format = request.ResponseFormat.Schema
+	}
+	return result
+}
+
+func (l *LocalClient) llamaCppRequest(request ChatRequest, stream bool) llamaCppRequest {
+	result := llamaCppRequest{
+		Model:       request.Model,
+		Stream:      stream,
+		Temperature: request.Temperature,
+		MaxTokens:   request.MaxTokens,
+	}
+	for _, m := range request.Messages {
+		result.Messages = append(result.Messages, llamaCppMessage{Role: m.Role, Content: m.Content})
+		result.CachePrompt = result.CachePrompt || m.Cache
+	}
+	if request.ResponseFormat != nil {
+		result.ResponseFormat = map[string]any{
+			"type":        "json_schema",
+			"json_schema": map[string]any{"name": request.ResponseFormat.Name, "schema": request.ResponseFormat.Schema},
+		}
+	}
+	return result
+}
+
+// ollamaFinishReason maps Ollama's done_reason onto the OpenAI names.
+func ollamaFinishReason(reason string) string {
+	if reason == "" {
+		return "stop"
+	}
+	return reason
+}
+
+func (l *LocalClient) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	if l.flavor == "ollama" {
+		resp, err := l.post(ctx, "/api/chat", l.ollamaRequest(request, false))
+		if err != nil {
+			return ChatResponse{}, err
+		}
+		defer resp.Body.Close()
+
+		var response ollamaResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return ChatResponse{}, fmt.Errorf("ollama: decoding response: %w", err)
+		}
+		if response.Error != "" {
+			return ChatResponse{}, fmt.Errorf("ollama: %s", response.Error)
+		}
+		return ChatResponse{
+			Model:        response.Model,
+			Content:      response.Message.Content,
+			FinishReason: ollamaFinishReason(response.DoneReason),
+			Usage:        Usage{InputTokens: response.PromptEvalCount, OutputTokens: response.EvalCount},
+		}, nil
+	}
+
+	resp, err := l.post(ctx, "/v1/chat/completions", l.llamaCppRequest(request, false))
+	if err != nil {
+		return ChatResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var response llamaCppResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return ChatResponse{}, fmt.Errorf("llamacpp: decoding response: %w", err)
+	}
+
+	result := ChatResponse{Model: response.Model, Usage: response.usage()}
+	if result.Model == "" {
+		result.Model = request.Model
+	}
+	if len(response.Choices) > 0 {
+		result.Content = response.Choices[0].Message.Content
+		result.FinishReason = response.Choices[0].FinishReason
+	}
+	return result, nil
+}
+
+func (r llamaCppResponse) usage() Usage {
+	if r.Usage != nil {
+		return Usage{InputTokens: r.Usage.PromptTokens, OutputTokens: r.Usage.CompletionTokens}
+	}
+	if r.Timings != nil {
+		return Usage{InputTokens: r.Timings.PromptN, OutputTokens: r.Timings.PredictedN}
+	}
+	return Usage{}
+}
+
+func (l *LocalClient) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	var resp *http.Response
+	var err error
+	if l.flavor == "ollama" {
+		resp, err = l.post(ctx, "/api/chat", l.ollamaRequest(request, true))
+	} else {
+		resp, err = l.post(ctx, "/v1/chat/completions", l.llamaCppRequest(request, true))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &localStream{body: resp.Body, flavor: l.flavor}
+	if l.flavor == "ollama" {
+		stream.lines = bufio.NewScanner(resp.Body)
+		stream.lines.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	} else {
+		stream.events = newSSEReader(resp.Body)
+	}
+	return stream, nil
+}
+
+func (s *localStream) Recv() (ChatStreamChunk, error) {
+	if s.done {
+		return ChatStreamChunk{}, io.EOF
+	}
+	if s.flavor == "ollama" {
+		return s.recvOllama()
+	}
+	return s.recvLlamaCpp()
+}
+
+// recvOllama reads newline delimited JSON objects; the last one has done set
+// and carries the token counts. A stream that ends without it was cut off.
+func (s *localStream) recvOllama() (ChatStreamChunk, error) {
+	for s.lines.Scan() {
+		line := strings.TrimSpace(s.lines.Text())
+		if line == "" {
+			continue
+		}
+
+		var response ollamaResponse
+		if err := json.Unmarshal([]byte(line), &response); err != nil {
+			return ChatStreamChunk{}, fmt.Errorf("ollama: decoding stream: %w", err)
+		}
+		if response.Error != "" {
+			return ChatStreamChunk{}, fmt.Errorf("ollama: %s", response.Error)
+		}
+
+		chunk := ChatStreamChunk{Content: response.Message.Content}
+		if response.Done {
+			s.done = true
+			s.usage = Usage{InputTokens: response.PromptEvalCount, OutputTokens: response.EvalCount}
+			chunk.FinishReason = ollamaFinishReason(response.DoneReason)
+		}
+		return chunk, nil
+	}
+	if err := s.lines.Err(); err != nil {
+		return ChatStreamChunk{}, err
+	}
+	return ChatStreamChunk{}, io.ErrUnexpectedEOF
+}
+
+// recvLlamaCpp reads SSE chunks. Depending on the llama.cpp version the
+// stream may or may not end with [DONE], and usage may only be present as
+// timings on the last chunk.
+func (s *localStream) recvLlamaCpp() (ChatStreamChunk, error) {
+	for {
+		event, err := s.events.Next()
+		if errors.Is(err, io.EOF) {
+			s.done = true
+			return ChatStreamChunk{}, io.EOF
+		}
+		if err != nil {
+			return ChatStreamChunk{}, err
+		}
+		if event.Data == "[DONE]" {
+			s.done = true
+			return ChatStreamChunk{}, io.EOF
+		}
+
+		var response llamaCppResponse
+		if err := json.Unmarshal([]byte(event.Data), &response); err != nil {
+			return ChatStreamChunk{}, fmt.Errorf("llamacpp: decoding stream: %w", err)
+		}
+		if usage := response.usage(); usage.InputTokens > 0 || usage.OutputTokens > 0 {
+			s.usage = usage
+		}
+		if len(response.Choices) == 0 {
+			continue
+		}
+		return ChatStreamChunk{
+			Content:      response.Choices[0].Delta.Content,
+			FinishReason: response.Choices[0].FinishReason,
+		}, nil
+	}
+}
+
+func (s *localStream) Usage() Usage {
+	return s.usage
+}
+
+func (s *localStream) Close() error {
+	return s.body.Close()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLocalStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		flavor string
+		path   string // of the chat endpoint
+		body   string
+		usage  Usage
+	}{
+		{
+			name:   "ollama",
+			flavor: "ollama",
+			path:   "/api/chat",
+			body: `{"model":"qwen","message":{"role":"assistant","content":"Hello"},"done":false}
+{"model":"qwen","message":{"role":"assistant","content":", world"},"done":false}
+{"model":"qwen","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":30,"eval_count":4}
+`,
+			usage: Usage{InputTokens: 30, OutputTokens: 4},
+		},
+		{
+			name:   "llama.cpp with usage",
+			flavor: "llamacpp",
+			path:   "/v1/chat/completions",
+			body: `data: {"choices":[{"delta":{"content":"Hello"}}]}
+
+data: {"choices":[{"delta":{"content":", world"},"finish_reason":"stop"}]}
+
+data: {"choices":[],"usage":{"prompt_tokens":30,"completion_tokens":4}}
+
+data: [DONE]
+
+`,
+			usage: Usage{InputTokens: 30, OutputTokens: 4},
+		},
+		{
+			name:   "llama.cpp with timings and no [DONE]",
+			flavor: "llamacpp",
+			path:   "/v1/chat/completions",
+			body: `data: {"choices":[{"delta":{"content":"Hello"}}]}
+
+data: {"choices":[{"delta":{"content":", world"},"finish_reason":"stop"}],"timings":{"prompt_n":30,"predicted_n":4}}
+
+`,
+			usage: Usage{InputTokens: 30, OutputTokens: 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/tags":
+					// how the client tells Ollama from llama.cpp
+					if tt.flavor != "ollama" {
+						http.NotFound(w, r)
+					}
+				case tt.path:
+					fmt.Fprint(w, tt.body)
+				default:
+					t.Errorf("unexpected request to %s", r.URL.Path)
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			client := newLocalClient(Config{OrBase: server.URL})
+			if client.flavor != tt.flavor {
+				t.Fatalf("detected %s, want %s", client.flavor, tt.flavor)
+			}
+			stream, err := client.CreateChatCompletionStream(context.Background(), ChatRequest{
+				Model:    "qwen",
+				Messages: []ChatMessage{{Role: RoleUser, Content: "hi"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+
+			var content strings.Builder
+			var finishReason string
+			for {
+				chunk, err := stream.Recv()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				content.WriteString(chunk.Content)
+				if chunk.FinishReason != "" {
+					finishReason = chunk.FinishReason
+				}
+			}
+
+			if got := content.String(); got != "Hello, world" {
+				t.Errorf("content = %q, want %q", got, "Hello, world")
+			}
+			if finishReason != "stop" {
+				t.Errorf("finish reason = %q, want stop", finishReason)
+			}
+			if usage := stream.Usage(); usage != tt.usage {
+				t.Errorf("usage = %+v, want %+v", usage, tt.usage)
+			}
+			if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+				t.Errorf("Recv() after the end = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestOllamaStreamCutOff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/chat" {
+			fmt.Fprintln(w, `{"model":"qwen","message":{"role":"assistant","content":"Hel"},"done":false}`)
+		}
+	}))
+	defer server.Close()
+
+	stream, err := newLocalClient(Config{OrBase: server.URL}).CreateChatCompletionStream(context.Background(), ChatRequest{Model: "qwen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	if chunk, err := stream.Recv(); err != nil || chunk.Content != "Hel" {
+		t.Fatalf("Recv() = %+v, %v, want the first chunk", chunk, err)
+	}
+	if _, err := stream.Recv(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Recv() at the cut = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestDetectLocalServerOnce(t *testing.T) {
+	probes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/tags" {
+			probes++
+		}
+	}))
+	defer server.Close()
+
+	for _, base := range []string{server.URL, server.URL + "/v1", server.URL + "/"} {
+		if _, flavor := detectLocalServer(base); flavor != "ollama" {
+			t.Errorf("detectLocalServer(%s) = %s, want ollama", base, flavor)
+		}
+	}
+	if probes != 1 {
+		t.Errorf("server was probed %d times, want once", probes)
+	}
+}
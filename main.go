@@ -12,17 +12,20 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
-	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
-	"text/template"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
-	"github.com/sashabaranov/go-openai"
 	"golang.org/x/mod/modfile"
 )
 
@@ -38,54 +41,74 @@ type FileContent struct {
 }
 
 type Config struct {
-	OrBase          string
-	OrToken         string
-	OrLow           string
-	OrHigh          string
-	Files           string
-	Prompt          string
-	GitBranch       string
-	BranchPrompt    string
-	ChangesPrompt   string
-	CommitMsgPrompt string
-	FixJsonPrompt   string
-	ProjectName     string
-	Merge           bool
-	Remove          bool
-	SplitFiles      string
-	UnsplitFiles    string
-	FixBuild        bool
-	FixTests        bool
-	RetryOnErrors   bool
-	NoGopart        bool
-	PromptFile      string // New field for -promptFile flag
+	Provider           string
+	OrBase             string
+	OrToken            string
+	OrLow              string
+	OrHigh             string
+	Files              string
+	Prompt             string
+	GitBranch          string
+	BranchPrompt       string
+	ChangesPrompt      string
+	CommitMsgPrompt    string
+	FixJsonPrompt      string
+	ProjectName        string
+	Merge              bool
+	Remove             bool
+	SplitFiles         string
+	UnsplitFiles       string
+	FixBuild           bool
+	FixTests           bool
+	RetryOnErrors      bool
+	NoGopart           bool
+	PromptFile         string // New field for -promptFile flag
+	MaxRetries         int
+	PricingFile        string
+	OpenRouterCost     bool
+	Budget             Budget
+	Cache              CacheConfig
+	Record             string
+	Replay             string
+	Fallback           FallbackConfig
+	ContextBudget      int
+	ToolMode           bool
+	NoStructuredOutput bool
+	HistoryTokens      int
+	NewConversation    bool
+	Candidates         CandidateConfig
+	RoutingFile        string
+	NoRouting          bool
+	Task               string // the kind of task, when known without looking at the prompt
+	RepoMap            RepoMapConfig
 }
 
 type Session struct {
-	TotalCost float64
-	Requests  int
+	TotalCost    float64
+	Requests     int
+	InputTokens  int
+	OutputTokens int
+	CacheHits    int
+	ChangesModel string // the model that produced the last changes
+
+	// prompt caching by the provider
+	PromptCacheHits   int
+	CachedInputTokens int
 }
 
 var currentSession Session
 
-type WrappedOpenAIClient struct {
-	client *openai.Client
-}
+// sessionMu guards currentSession, and the warnings about prices and budgets,
+// while candidates are generated concurrently.
+var sessionMu sync.Mutex
 
-func getPromptContent(userFile, defaultFile string) string {
-	if userFile != "" {
-		content, err := os.ReadFile(userFile)
-		if err == nil {
-			return string(content)
-		}
-		log.Printf("Warning: Could not read user-provided prompt file %s. Using default. in getPromptContent", userFile)
-	}
+// warnedModels holds the models we already warned about missing prices for.
+var warnedModels = map[string]bool{}
 
-	content, err := promptFS.ReadFile(defaultFile)
-	if err != nil {
-		log.Fatalf("Error reading default prompt file %s: %v  in getPromptContent", defaultFile, err)
-	}
-	return string(content)
+// getPromptContent returns the prompt defaultFile (as in prompts/), or
+// userFile when that is set. See resolvePrompt for the overrides in between.
+func getPromptContent(userFile, defaultFile string) string {
+	return resolvePrompt(path.Base(defaultFile), userFile).read()
 }
 
 func writeSplitOrder(path string, order []string) error {
@@ -99,12 +122,16 @@ func writeSplitOrder(path string, order []string) error {
 
 func main() {
 	config := loadConfig()
-	RunGopilot(config)
+	if err := RunGopilot(context.Background(), config); err != nil {
+		os.Exit(1)
+	}
 }
 
-func processLocations(changes []FileContent) []FileContent {
+// processLocations updates the split orders in the project in dir for where
+// changes go, and takes the insertion points out of their content.
+func processLocations(dir string, changes []FileContent) []FileContent {
 	for i, change := range changes {
-		baseDir := filepath.Dir(change.FilePath)
+		baseDir := filepath.Join(dir, filepath.Dir(change.FilePath))
 		splitOrderPath := filepath.Join(baseDir, "splitorder.json")
 		splitOrder, err := readSplitOrder(splitOrderPath)
 		if err != nil {
@@ -132,32 +159,54 @@ func processLocations(changes []FileContent) []FileContent {
 	return changes
 }
 
-func commitChanges(config Config) {
-	commitMsg := generateCommitMessage(config)
-	cmd := exec.Command("git", "add", ".")
+func commitChanges(ctx context.Context, config Config) {
+	commitMsg := generateCommitMessage(ctx, config)
+	cmd := exec.CommandContext(ctx, "git", "add", ".")
 	err := cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Fatal(err)
 	}
 
-	cmd = exec.Command("git", "commit", "-m", commitMsg)
+	cmd = exec.CommandContext(ctx, "git", "commit", "-m", commitMsg)
 	err = cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Fatal(err)
 	}
 }
 
-func RunGopilot(config Config) {
+// RunGopilot does what config asks for. Errors end the run where they
+// happen, except for running out of budget, which is returned once the
+// repository is left in order.
+func RunGopilot(ctx context.Context, config Config) error {
 	checkGoVersion()
 
 	if config.SplitFiles != "" {
 		splitGoFiles(config.SplitFiles)
-		return
+		return nil
 	}
 
 	if config.UnsplitFiles != "" {
-		unsplitGoFiles(config.UnsplitFiles)
-		return
+		unsplitGoFiles(".", config.UnsplitFiles)
+		return nil
+	}
+
+	// Ctrl-C from here on cancels ctx; exitIfInterrupted then restores the
+	// repository as it is now. Before this, Ctrl-C simply exits, as while
+	// reading the -inter prompt.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	runSnapshot = takeSnapshot()
+
+	// -merge and -rm without a prompt act on the branch we're on
+	if config.Merge && config.Prompt == "" {
+		mergeAndCleanup(ctx, config, getCurrentBranch())
+		return nil
+	}
+	if config.Remove && config.Prompt == "" {
+		removeAndCleanup(ctx, getCurrentBranch())
+		return nil
 	}
 
 	// Automatically split all *.go files in the root directory
@@ -169,14 +218,15 @@ func RunGopilot(config Config) {
 		splitGoFiles(strings.Join(goFiles, ","))
 	}
 
+	// continue the conversation of the gopilot branch we're on, if any
+	currentConversation = loadConversation(getCurrentBranch())
+
 	if config.FixBuild {
-		fixBuild(config)
-		return
+		return stopIfBudgetExceeded(config, fixBuild(ctx, config))
 	}
 
 	if config.FixTests {
-		fixTests(config)
-		return
+		return stopIfBudgetExceeded(config, fixTests(ctx, config))
 	}
 
 	files := readFiles(config.Files, config)
@@ -187,23 +237,36 @@ func RunGopilot(config Config) {
 	}
 	// os.Exit(0)
 
+	var err error
 	if config.Prompt != "" {
-		prompt(config, files)
+		err = stopIfBudgetExceeded(config, prompt(ctx, config, files))
 	}
 
-	// Print session summary
-	fmt.Printf("Session summary:\nTotal requests: %d\nTotal cost: $%.2f\n", currentSession.Requests, currentSession.TotalCost)
+	printSessionSummary()
+	return err
 }
 
-func mergeAndCleanup(branchName string) {
+func printSessionSummary() {
+	if currentSession.ChangesModel != "" {
+		fmt.Println("Changes generated by:", currentSession.ChangesModel)
+	}
+	fmt.Printf("Session summary:\nTotal requests: %d\nCached responses: %d\nInput tokens: %d\n", currentSession.Requests, currentSession.CacheHits, currentSession.InputTokens)
+	if currentSession.PromptCacheHits > 0 {
+		fmt.Printf("Prompt cache hits: %d requests, %d input tokens (%.0f%%)\n", currentSession.PromptCacheHits, currentSession.CachedInputTokens, 100*float64(currentSession.CachedInputTokens)/float64(currentSession.InputTokens))
+	}
+	fmt.Printf("Output tokens: %d\nTotal cost: $%.2f\n", currentSession.OutputTokens, currentSession.TotalCost)
+}
+
+func mergeAndCleanup(ctx context.Context, config Config, branchName string) {
 
 	if branchName == "main" {
 		log.Fatal("Cannot delete main branch.")
 	}
 	// Check for uncommitted changes
-	cmd := exec.Command("git", "status", "--porcelain")
+	cmd := exec.CommandContext(ctx, "git", "status", "--porcelain")
 	output, err := cmd.Output()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Fatal("Error checking git status:", err)
 	}
 
@@ -212,96 +275,111 @@ func mergeAndCleanup(branchName string) {
 		fmt.Println("Uncommitted changes detected. Committing before merge...")
 
 		// Stage all changes
-		cmd = exec.Command("git", "add", "-A")
+		cmd = exec.CommandContext(ctx, "git", "add", "-A")
 		err = cmd.Run()
 		if err != nil {
+			exitIfInterrupted(ctx)
 			log.Fatal("Error staging changes:", err)
 		}
 
 		// Generate commit message
-		config := loadConfig()
-		commitMsg := generateCommitMessage(config)
+		commitMsg := generateCommitMessage(ctx, config)
 
 		// Commit changes
-		cmd = exec.Command("git", "commit", "-m", commitMsg)
+		cmd = exec.CommandContext(ctx, "git", "commit", "-m", commitMsg)
 		err = cmd.Run()
 		if err != nil {
+			exitIfInterrupted(ctx)
 			log.Fatal("Error committing changes:", err)
 		}
 
 		fmt.Println("Uncommitted changes have been committed.")
 	}
 
+	// Ctrl-C from here on resets main as well
+	if runSnapshot != nil {
+		runSnapshot.mainHead, _ = git("rev-parse", "--verify", "main")
+	}
+
 	// Checkout main
-	cmd = exec.Command("git", "checkout", "main")
+	cmd = exec.CommandContext(ctx, "git", "checkout", "main")
 	output, err = cmd.CombinedOutput()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Fatal("Error checking out main branch:", string(output), err)
 	}
 
 	// Merge the branch
-	cmd = exec.Command("git", "merge", branchName)
+	cmd = exec.CommandContext(ctx, "git", "merge", branchName)
 	err = cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Fatal("Error merging branch:", err)
 	}
 
 	// Push changes
-	cmd = exec.Command("git", "push")
+	cmd = exec.CommandContext(ctx, "git", "push")
 	err = cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Fatal("Error pushing changes:", err)
 	}
 
 	// Delete the branch
-	cmd = exec.Command("git", "branch", "-D", branchName)
+	cmd = exec.CommandContext(ctx, "git", "branch", "-D", branchName)
 	err = cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Fatal("Error deleting branch:", err)
 	}
 
+	deleteConversation(branchName)
 	fmt.Printf("Branch %s merged into main, pushed, and deleted.\n", branchName)
 }
 
-func fixBuild(config Config) {
-	cmd := exec.Command("make", "build")
+func fixBuild(ctx context.Context, config Config) error {
+	cmd := exec.CommandContext(ctx, "make", "build")
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
 	err := cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		fmt.Println("Build failed. Error output:")
 		fmt.Println(stdout.String())
 		fmt.Println(stderr.String())
 
 		// Generate a prompt to fix the build errors
 		promptContent := getPromptContent(config.FixJsonPrompt, "prompts/fix_build.txt")
-		tmpl, err := template.New("fixbuild").Parse(promptContent)
+		tmpl, err := parsePromptTemplate("fixbuild", promptContent)
 		if err != nil {
 			log.Fatal(err, "in fixBuild: template parsing")
 		}
 
-		var promptBuffer bytes.Buffer
-		err = tmpl.Execute(&promptBuffer, map[string]string{
+		prompt, err := tmpl.text(promptData(ctx, tmpl.fields(), map[string]string{
 			"BuildErrors": stdout.String() + "\n" + stderr.String(),
 			"ProjectName": config.ProjectName,
-		})
+		}))
 		if err != nil {
 			log.Fatal(err, "in fixBuild: template execution")
 		}
 
 		// Use the generated prompt to fix the build errors
-		config.Prompt = promptBuffer.String()
+		config.Prompt = prompt
+		config.Task = taskBuildRepair
 		files := readGoPartFiles("editor")
-		changes := generateChanges(config, files)
-		applyChanges(changes)
+		changes, err := generateChanges(ctx, config, files)
+		if err != nil {
+			return err
+		}
+		applyChanges(ctx, ".", changes)
 
 		// Attempt to build again
-		if !buildSucceeds() {
+		if !buildSucceeds(ctx, ".") {
 			// If build still fails, recursively call fixBuild
 			if config.RetryOnErrors {
-				fixBuild(config)
+				return fixBuild(ctx, config)
 			}
 		} else {
 			fmt.Println("Build errors fixed successfully.")
@@ -309,6 +387,7 @@ func fixBuild(config Config) {
 	} else {
 		fmt.Println("Build succeeded. No fixes needed.")
 	}
+	return nil
 }
 
 func addFileContent(files *[]FileContent, path string) {
@@ -344,10 +423,11 @@ func addFileContent(files *[]FileContent, path string) {
 	}
 }
 
-func showDiff() {
-	cmd := exec.Command("git", "diff", "--cached", "main")
+func showDiff(ctx context.Context) {
+	cmd := exec.CommandContext(ctx, "git", "diff", "--cached", "main")
 	output, err := cmd.Output()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Printf("Error getting diff: %v", err)
 		return
 	}
@@ -404,12 +484,13 @@ func writeGopart(dir, filename, content string) {
 	}
 }
 
-func checkoutBranch(branchName string) {
-	cmd := exec.Command("git", "checkout", "-b", branchName)
+func checkoutBranch(ctx context.Context, branchName string) {
+	cmd := exec.CommandContext(ctx, "git", "checkout", "-b", branchName)
 	err := cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		fmt.Println(err, cmd, " in checkoutBranch, not fatal")
-		cmd := exec.Command("git", "checkout", branchName)
+		cmd := exec.CommandContext(ctx, "git", "checkout", branchName)
 		cmd.Run()
 		//log.Fatal(err, cmd, " in checkoutBranch")
 	}
@@ -424,8 +505,10 @@ func contains(slice []string, item string) bool {
 	return false
 }
 
-func unsplitGoFile(filename string) {
-	baseDir := filepath.Join("editor", strings.TrimSuffix(filename, ".go"))
+// unsplitGoFile recreates filename in the project in dir from its .gopart
+// files.
+func unsplitGoFile(dir, filename string) {
+	baseDir := filepath.Join(dir, "editor", strings.TrimSuffix(filename, ".go"))
 
 	// Check if the directory exists
 	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
@@ -461,7 +544,7 @@ func unsplitGoFile(filename string) {
 	combinedContent = strings.ReplaceAll(combinedContent, "\x00", "")
 
 	// Write the combined content to the original .go file
-	err = os.WriteFile(filename, []byte(combinedContent), 0644)
+	err = os.WriteFile(filepath.Join(dir, filename), []byte(combinedContent), 0644)
 	if err != nil {
 		log.Fatalf("Error writing file %s: %v", filename, err)
 	}
@@ -489,15 +572,17 @@ func isPackageInModFile(modFile *modfile.File, packageName string) bool {
 	return false
 }
 
-func runGoModTidy() {
-	cmd := exec.Command("go", "mod", "tidy")
+func runGoModTidy(ctx context.Context, dir string) error {
+	cmd := exec.CommandContext(ctx, "go", "mod", "tidy")
+	cmd.Dir = dir
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
 	err := cmd.Run()
 	if err != nil {
-		log.Fatalf("Error running go mod tidy: %v\n%s", err, stderr.String())
+		return fmt.Errorf("running go mod tidy: %v\n%s", err, stderr.String())
 	}
+	return nil
 }
 
 func removeInsertionPoint(content string) string {
@@ -524,74 +609,93 @@ func readInteractivePrompt() string {
 	return strings.Join(lines, "\n")
 }
 
-func runGoGet() {
-	cmd := exec.Command("go", "get", "./...")
+func runGoGet(ctx context.Context, dir string) error {
+	cmd := exec.CommandContext(ctx, "go", "get", "./...")
+	cmd.Dir = dir
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
 	err := cmd.Run()
 	if err != nil {
-		log.Fatalf("Error running go get: %v\n%s", err, stderr.String())
+		return fmt.Errorf("running go get: %v\n%s", err, stderr.String())
 	}
+	return nil
 }
 
-func generateCommitMessage(config Config) string {
-	client := createOpenAIClient(config)
+func generateCommitMessage(ctx context.Context, config Config) string {
+	client := createProvider(config)
 
 	promptContent := getPromptContent(config.CommitMsgPrompt, "prompts/commit_message.txt")
-	tmpl, err := template.New("commit").Parse(promptContent)
+	tmpl, err := parsePromptTemplate("commit", promptContent)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	var promptBuffer bytes.Buffer
-	err = tmpl.Execute(&promptBuffer, map[string]string{
+	messages, err := tmpl.messages(promptData(ctx, tmpl.fields(), map[string]string{
 		"Prompt":      config.Prompt,
 		"ProjectName": config.ProjectName,
-	})
+	}), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: config.OrLow,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: promptBuffer.String(),
-				},
-			},
-		},
+	resp, err := complete(
+		ctx,
+		client,
+		config,
+		roleLow,
+		messages,
 	)
 
 	if err != nil {
+		exitIfInterrupted(ctx)
+		if errors.Is(err, ErrBudgetExceeded) {
+			// changes that build are worth committing even so
+			log.Printf("Warning: %v; committing with the prompt as the message", err)
+			return defaultCommitMessage(config)
+		}
 		log.Fatal(err)
 	}
 
-	fmt.Println("commit message suggestion: ", resp.Choices[0].Message.Content)
+	fmt.Println("commit message suggestion: ", resp.Content)
 
-	return strings.TrimSpace(resp.Choices[0].Message.Content)
+	return strings.TrimSpace(resp.Content)
 }
 
-func createOpenAIClient(config Config) *WrappedOpenAIClient {
-	_config := openai.DefaultConfig(config.OrToken)
-	_config.BaseURL = config.OrBase
-	client := openai.NewClientWithConfig(_config)
-
-	return &WrappedOpenAIClient{
-		client: client,
+// defaultCommitMessage is the first line of the prompt, for when the model
+// can't be asked.
+func defaultCommitMessage(config Config) string {
+	message, _, _ := strings.Cut(strings.TrimSpace(config.Prompt), "\n")
+	if message == "" {
+		return "Changes made by gopilot"
 	}
+	return message
 }
 
-func prompt(config Config, files []FileContent) {
+func prompt(ctx context.Context, config Config, files []FileContent) error {
 	//files := readGoPartFiles("editor")
-	branchName := generateBranchName(config, files)
-	checkoutBranch(branchName)
+	branchName := getCurrentBranch()
+	if currentConversation == nil || config.NewConversation {
+		newBranch, err := generateBranchName(ctx, config, files)
+		if err != nil {
+			return err
+		}
+		checkoutBranch(ctx, newBranch)
+		branchName = getCurrentBranch()
+		currentConversation = loadConversation(branchName)
+		if currentConversation == nil || config.NewConversation {
+			currentConversation = &Conversation{Branch: branchName}
+		}
+	} else {
+		fmt.Printf("Continuing the conversation on branch %s (%d earlier prompts)\n", branchName, len(currentConversation.Turns))
+	}
 
-	changes := generateChanges(config, files)
-	applyChanges(changes)
+	changes, err := generateChanges(ctx, config, files)
+	if err != nil {
+		return err
+	}
+	applyChanges(ctx, ".", changes)
+	exitIfInterrupted(ctx)
 
 	// Unsplit files after changes are applied
 
@@ -600,28 +704,72 @@ func prompt(config Config, files []FileContent) {
 		if err != nil {
 			log.Fatal("Error finding Go files:", err)
 		}
-		unsplitGoFiles(strings.Join(goFiles, ","))
+		unsplitGoFiles(".", strings.Join(goFiles, ","))
 	}
 
-	updateDependencies()
+	updateDependencies(ctx)
 
-	ensureGoimportsInstalled()
-	runGoimports()
+	ensureGoimportsInstalled(ctx)
+	runGoimports(ctx, ".")
 
-	if buildSucceeds() {
-		commitChanges(config)
+	if buildSucceeds(ctx, ".") {
+		commitChanges(ctx, config)
 		fmt.Println("Changes applied and committed successfully.")
 
 		// this is a bit useless as it feels like we overwritten all... 
-		// showDiff()
+		// showDiff(ctx)
 
 		if config.Merge {
-			mergeAndCleanup(branchName)
+			mergeAndCleanup(ctx, config, branchName)
 		}
 	} else {
 		fmt.Println("Build failed. Please fix the issues and try again.")
-		fixBuild(config)
+		return fixBuild(ctx, config)
+	}
+	return nil
+}
+
+func envString(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func envInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %v", name, err)
+	}
+	return n
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %v", name, err)
 	}
+	return d
+}
+
+func envFloat(name string, defaultValue float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %v", name, err)
+	}
+	return f
 }
 
 func loadConfig() Config {
@@ -629,16 +777,14 @@ func loadConfig() Config {
 	godotenv.Load()
 
 	config := Config{
-		OrBase:  os.Getenv("OR_BASE"),
-		OrToken: os.Getenv("OR_TOKEN"),
-		OrLow:   os.Getenv("OR_LOW"),
-		OrHigh:  os.Getenv("OR_HIGH"),
-	}
-
-	if config.OrBase == "" {
-		config.OrBase = "https://openrouter.ai/api/v1/chat/completions"
+		Provider: os.Getenv("OR_PROVIDER"),
+		OrBase:   os.Getenv("OR_BASE"),
+		OrToken:  os.Getenv("OR_TOKEN"),
+		OrLow:    os.Getenv("OR_LOW"),
+		OrHigh:   os.Getenv("OR_HIGH"),
 	}
 
+	flag.StringVar(&config.Provider, "provider", config.Provider, "LLM backend to use: openai (default, also for OpenRouter), anthropic or local (Ollama / llama.cpp)")
 	flag.StringVar(&config.Files, "files", "", "Comma-separated list of files to process")
 	flag.StringVar(&config.Prompt, "prompt", "", "User prompt for changes")
 	flag.StringVar(&config.BranchPrompt, "branchprompt", "", "File containing the branch name prompt")
@@ -654,13 +800,105 @@ func loadConfig() Config {
 	flag.BoolVar(&config.RetryOnErrors, "retry-on-errors", false, "Only do automated fixBuild after prompting failure when this flag is present")
 	flag.BoolVar(&config.NoGopart, "no-gopart", false, "Disable the use of .gopart files and pass .go files directly")
 	flag.StringVar(&config.PromptFile, "promptFile", "", "File containing the prompt to run")
+	flag.StringVar(&config.PricingFile, "pricing", os.Getenv("OR_PRICING"), "JSON file with model prices, overriding the built-in ones")
+	flag.BoolVar(&config.OpenRouterCost, "openrouter-cost", os.Getenv("OR_OPENROUTER_COST") != "", "Use the cost OpenRouter reports per generation instead of the pricing table")
+	flag.Float64Var(&config.Budget.Session, "budget", envFloat("OR_BUDGET", 0), "Maximum spend in dollars for this run (0 = no limit)")
+	flag.Float64Var(&config.Budget.Daily, "daily-budget", envFloat("OR_DAILY_BUDGET", 0), "Maximum spend in dollars per day over all runs (0 = no limit)")
+	flag.Float64Var(&config.Budget.WarnPercent, "budget-warn", envFloat("OR_BUDGET_WARN", defaultBudgetWarn), "Warn when spending reaches this percentage of a budget")
+	flag.BoolVar(&config.Cache.Disabled, "no-cache", os.Getenv("OR_NO_CACHE") != "", "Don't use cached responses from .gopilot/cache")
+	flag.DurationVar(&config.Cache.TTL, "cache-ttl", envDuration("OR_CACHE_TTL", defaultCacheTTL), "How long cached responses stay valid")
+	flag.Int64Var(&config.Cache.MaxSize, "cache-max-size", int64(envInt("OR_CACHE_MAX_SIZE", defaultCacheMaxSize)), "Maximum size of the response cache in MB")
+	flag.BoolVar(&config.Cache.Prune, "cache-prune", false, "Remove expired and excess entries from the response cache and exit")
+	flag.StringVar(&config.Record, "record", "", "Record all LLM requests and responses to this cassette file")
+	flag.StringVar(&config.Replay, "replay", "", "Replay LLM responses from this cassette file instead of calling a model")
+	highFallbacks := flag.String("high-fallbacks", os.Getenv("OR_HIGH_FALLBACKS"), "Comma-separated models to try in order when OR_HIGH fails")
+	lowFallbacks := flag.String("low-fallbacks", os.Getenv("OR_LOW_FALLBACKS"), "Comma-separated models to try in order when OR_LOW fails")
+	fallbackOn := flag.String("fallback-on", envString("OR_FALLBACK_ON", defaultFallbackOn), "When to fall back to the next model: error, length and/or invalid-json")
+	flag.BoolVar(&config.ToolMode, "tool-mode", os.Getenv("OR_TOOL_MODE") != "", "Have the model make changes through tool calls instead of printing JSON")
+	flag.BoolVar(&config.NoStructuredOutput, "no-structured-output", os.Getenv("OR_NO_STRUCTURED_OUTPUT") != "", "Don't send a JSON schema for the changes to backends that support structured output")
+	flag.IntVar(&config.HistoryTokens, "history-tokens", envInt("OR_HISTORY_TOKENS", defaultHistoryTokens), "Summarize the conversation on a branch once it takes more tokens than this")
+	flag.BoolVar(&config.NewConversation, "new-conversation", false, "Start a new branch and conversation even when on a gopilot branch")
+	flag.IntVar(&config.Candidates.Count, "candidates", envInt("OR_CANDIDATES", 1), "Number of candidate change sets to generate; the best one that builds is kept")
+	flag.IntVar(&config.Candidates.Parallel, "candidate-parallel", envInt("OR_CANDIDATE_PARALLEL", defaultCandidateParallel), "How many candidates to generate at the same time")
+	candidateTemperatures := flag.String("candidate-temperatures", os.Getenv("OR_CANDIDATE_TEMPERATURES"), "Comma-separated temperatures for the candidates (default: spread from 0.2 to 1.0)")
+	flag.BoolVar(&config.Candidates.Tests, "candidate-tests", os.Getenv("OR_CANDIDATE_TESTS") != "", "Also run make test on each candidate and prefer the ones that pass")
+	flag.StringVar(&config.RoutingFile, "routing", os.Getenv("OR_ROUTING"), "JSON file with model routing rules, overriding the built-in ones")
+	flag.BoolVar(&config.NoRouting, "no-routing", os.Getenv("OR_NO_ROUTING") != "", "Always generate changes with OR_HIGH instead of routing by task")
+	flag.BoolVar(&config.RepoMap.Enabled, "repo-map", os.Getenv("OR_REPO_MAP") != "", "Send a map of the declarations in the project, and only the files likely to change in full")
+	flag.IntVar(&config.RepoMap.Bodies, "repo-map-bodies", envInt("OR_REPO_MAP_BODIES", defaultRepoMapBodies), "How many of the most relevant symbols to send the bodies of with -repo-map")
+	disableOpinions := flag.String("disable-opinions", os.Getenv("OR_DISABLE_OPINIONS"), "Comma-separated built-in prompt opinions to turn off: "+strings.Join(opinionNames(), ", "))
+	flag.IntVar(&config.ContextBudget, "context-budget", envInt("OR_CONTEXT_BUDGET", 0), "Context window in tokens to fit the project files in (0 = from the pricing table)")
+	flag.IntVar(&config.MaxRetries, "max-retries", envInt("OR_MAX_RETRIES", defaultMaxRetries), "How often to retry a failed or interrupted LLM request")
+
+	listPromptsFlag := flag.Bool("list-prompts", false, "List where each prompt comes from and exit")
+	exportPromptsDir := flag.String("export-prompts", "", "Write the built-in prompts to this directory and exit")
+	lintPromptsFlag := flag.Bool("lint-prompts", false, "Check the prompts for fields their callers don't supply and exit")
 
 	// Add the new flag for interactive prompt
 	interactive := flag.Bool("inter", false, "Use interactive prompt")
 
 	flag.Parse()
 
-	if config.OrBase == "" || config.OrToken == "" || config.OrLow == "" || config.OrHigh == "" {
+	if config.Cache.Prune {
+		pruneCacheCommand(config)
+		os.Exit(0)
+	}
+
+	if *listPromptsFlag {
+		listPrompts(config)
+		os.Exit(0)
+	}
+
+	if *exportPromptsDir != "" {
+		exportPrompts(*exportPromptsDir)
+		os.Exit(0)
+	}
+
+	parseDisabledOpinions(*disableOpinions)
+
+	if *lintPromptsFlag {
+		if lintPrompts(config) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	config.Fallback.High = splitList(*highFallbacks)
+	config.Fallback.Low = splitList(*lowFallbacks)
+	parseFallbackOn(&config.Fallback, *fallbackOn)
+	config.Candidates.Temperatures = parseTemperatures(*candidateTemperatures)
+
+	if config.OrBase == "" {
+		config.OrBase = defaultBaseURL(config.Provider)
+	}
+
+	if config.PricingFile != "" {
+		if err := loadPricing(config.PricingFile); err != nil {
+			log.Fatalf("Error loading pricing file: %v", err)
+		}
+	}
+
+	if config.RoutingFile != "" {
+		if err := loadRouting(config.RoutingFile); err != nil {
+			log.Fatalf("Error loading routing file: %v", err)
+		}
+	}
+
+	if config.Record != "" && config.Replay != "" {
+		log.Fatal("Use either -record or -replay, not both")
+	}
+
+	if config.ToolMode && config.Provider == "local" {
+		log.Fatal("-tool-mode is not supported with the local provider")
+	}
+
+	switch {
+	case config.Replay != "":
+		// replaying needs no backend; the models must be the ones recorded with
+	case config.Provider == "local":
+		// a local server needs no key and we pick the models from what it has
+		config.OrLow, config.OrHigh = resolveLocalModels(config)
+	case config.OrBase == "" || config.OrToken == "" || config.OrLow == "" || config.OrHigh == "":
 		log.Fatal("Missing required environment variables")
 	}
 
@@ -678,21 +916,7 @@ func loadConfig() Config {
 		config.Prompt = string(promptContent)
 	}
 
-	if config.Merge && config.Prompt == "" {
-		currentBranch := getCurrentBranch()
-		mergeAndCleanup(currentBranch)
-		// exit
-		os.Exit(0)
-	}
-
-	if config.Remove && config.Prompt == "" {
-		currentBranch := getCurrentBranch()
-		removeAndCleanup(currentBranch)
-		// exit
-		os.Exit(0)
-	}
-
-	if config.Prompt == "" && !config.Remove && config.SplitFiles == "" && config.UnsplitFiles == "" && !config.FixBuild && !config.FixTests {
+	if config.Prompt == "" && !config.Merge && !config.Remove && config.SplitFiles == "" && config.UnsplitFiles == "" && !config.FixBuild && !config.FixTests {
 		log.Fatal("Prompt is required or use -fix-build or -fix-tests flag")
 	}
 
@@ -709,18 +933,21 @@ func loadConfig() Config {
 	return config
 }
 
-func applyChanges(changes []FileContent) {
+// applyChanges writes changes to the project in dir.
+func applyChanges(ctx context.Context, dir string, changes []FileContent) {
 	for _, change := range changes {
-		dir := filepath.Dir(change.FilePath)
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
-			err := os.MkdirAll(dir, 0755)
+		exitIfInterrupted(ctx)
+		path := filepath.Join(dir, change.FilePath)
+		parent := filepath.Dir(path)
+		if _, err := os.Stat(parent); os.IsNotExist(err) {
+			err := os.MkdirAll(parent, 0755)
 			if err != nil {
-				log.Printf("Error creating directory %s: %v", dir, err)
+				log.Printf("Error creating directory %s: %v", parent, err)
 				continue
 			}
 
 			// If this is a new directory, create a new splitorder.json
-			splitOrderPath := filepath.Join(dir, "splitorder.json")
+			splitOrderPath := filepath.Join(parent, "splitorder.json")
 			if _, err := os.Stat(splitOrderPath); os.IsNotExist(err) {
 				initialOrder := []string{filepath.Base(change.FilePath)}
 				writeSplitOrder(splitOrderPath, initialOrder)
@@ -728,7 +955,7 @@ func applyChanges(changes []FileContent) {
 		}
 
 		if change.Delete {
-			err := os.Remove(change.FilePath)
+			err := os.Remove(path)
 			if err != nil {
 				log.Printf("Error deleting file %s: %v", change.FilePath, err)
 			} else {
@@ -736,16 +963,16 @@ func applyChanges(changes []FileContent) {
 			}
 		} else {
 			// Ensure the file exists before writing to it
-			if _, err := os.Stat(change.FilePath); os.IsNotExist(err) {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
 				// Create the file if it doesn't exist
-				_, err = os.Create(change.FilePath)
+				_, err = os.Create(path)
 				if err != nil {
 					log.Printf("Error creating file %s: %v", change.FilePath, err)
 					continue
 				}
 			}
 
-			err := os.WriteFile(change.FilePath, []byte(change.Content), 0644)
+			err := os.WriteFile(path, []byte(change.Content), 0644)
 			if err != nil {
 				log.Printf("Error writing file %s: %v", change.FilePath, err)
 			} else {
@@ -765,84 +992,89 @@ func readSplitOrder(path string) ([]string, error) {
 	return order, err
 }
 
-func generateAdditionalChanges(config Config, existingChanges []FileContent, remainingContent string) []FileContent {
-	client := createOpenAIClient(config)
+func generateAdditionalChanges(ctx context.Context, config Config, existingChanges []FileContent, remainingContent string) ([]FileContent, error) {
+	client := createProvider(config)
 
-	promptFile := config.ChangesPrompt
-	if promptFile == "" {
-		if config.NoGopart {
-			promptFile = "prompts/changes_no_goparts.txt"
-		} else {
-			promptFile = "prompts/changes_goparts.txt"
-		}
+	promptFile := "prompts/changes_goparts.txt"
+	if config.NoGopart {
+		promptFile = "prompts/changes_no_goparts.txt"
 	}
 
-	promptContent := getPromptContent(promptFile, promptFile)
+	promptContent := getPromptContent(config.ChangesPrompt, promptFile)
 	// promptContent := getPromptContent(config.ChangesPrompt, "prompts/changes.txt")
-	tmpl, err := template.New("changes").Parse(promptContent)
+	tmpl, err := parsePromptTemplate("changes", promptContent)
 	if err != nil {
 		log.Fatal(err, "in generateAdditionalChanges: template parsing")
 	}
 
 	existingChangesJSON, _ := json.Marshal(existingChanges)
-	var promptBuffer bytes.Buffer
-	err = tmpl.Execute(&promptBuffer, map[string]string{
+	messages, err := tmpl.messages(promptData(ctx, tmpl.fields(), map[string]string{
 		"Prompt":           config.Prompt,
 		"ExistingChanges":  string(existingChangesJSON),
 		"RemainingContent": remainingContent,
 		"ProjectName":      config.ProjectName,
-	})
+		"RepoMap":          "",
+		"Structured":       "",
+	}), nil)
 	if err != nil {
 		log.Fatal(err, "in generateAdditionalChanges: template execution")
 	}
+	messages = addConventions(messages, tmpl.fields())
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: config.OrHigh,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: promptBuffer.String(),
-				},
-			},
-		},
+	resp, err := complete(
+		ctx,
+		client,
+		config,
+		roleHigh,
+		messages,
 	)
 
 	if err != nil {
+		exitIfInterrupted(ctx)
+		if errors.Is(err, ErrBudgetExceeded) {
+			return nil, err
+		}
 		log.Fatal(err, "in generateAdditionalChanges")
 	}
 
-	fmt.Println("additional changes suggestion: ", resp.Choices[0].Message.Content)
+	fmt.Println("additional changes suggestion: ", resp.Content)
 
-	return parseChanges(config, resp.Choices[0].Message.Content)
+	return extractChanges(ctx, config, resp.Content), nil
 }
 
-func buildSucceeds() bool {
-	cmd := exec.Command("make", "build")
+// buildSucceeds runs make build in the project in dir.
+func buildSucceeds(ctx context.Context, dir string) bool {
+	cmd := exec.CommandContext(ctx, "make", "build")
+	cmd.Dir = dir
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
 	err := cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		fmt.Println("Build failed. Error output:")
 		fmt.Println(stderr.String())
+		currentConversation.addBuildResult(false, stderr.String())
 		return false
 	}
 
+	currentConversation.addBuildResult(true, "")
 	return true
 }
 
-func runGoimports() {
+// runGoimports formats the project in dir and fixes its imports.
+func runGoimports(ctx context.Context, dir string) {
 	goimportsPath, err := findGoimports()
 	if err != nil {
 		log.Println("Warning: Could not find goimports:", err)
 		return
 	}
 
-	cmd := exec.Command(goimportsPath, "-w", ".")
+	cmd := exec.CommandContext(ctx, goimportsPath, "-w", ".")
+	cmd.Dir = dir
 	err = cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Println("Warning: Failed to run goimports:", err)
 	}
 }
@@ -922,19 +1154,21 @@ func splitGoFile(filename string) {
 	fmt.Printf("Split %s into .gopart files in %s\n", filename, baseDir)
 }
 
-func unsplitGoFiles(fileList string) {
+// unsplitGoFiles recreates the files in fileList, and those of every
+// directory in editor, in the project in dir.
+func unsplitGoFiles(dir, fileList string) {
 	files := strings.Split(fileList, ",")
 	// if fileList == "" {
 	// Unsplit all files in ./editor/*
-	dirs, err := os.ReadDir("./editor")
+	dirs, err := os.ReadDir(filepath.Join(dir, "editor"))
 	if err != nil {
 		log.Fatalf("Error reading editor directory: %v", err)
 	}
 
-	for _, dir := range dirs {
-		if dir.IsDir() {
-			file := dir.Name() + ".go"
-			unsplitGoFile(file)
+	for _, editorDir := range dirs {
+		if editorDir.IsDir() {
+			file := editorDir.Name() + ".go"
+			unsplitGoFile(dir, file)
 			// remove file from files if it's there
 			for i, f := range files {
 				if f == file {
@@ -946,18 +1180,18 @@ func unsplitGoFiles(fileList string) {
 	// } else {
 
 	for _, file := range files {
-		unsplitGoFile(strings.TrimSpace(file))
+		unsplitGoFile(dir, strings.TrimSpace(file))
 	}
 	// }
 }
 
-func dependenciesNeedUpdate() bool {
-	goModContent, err := os.ReadFile("go.mod")
+func dependenciesNeedUpdate(dir string) bool {
+	goModContent, err := os.ReadFile(filepath.Join(dir, "go.mod"))
 	if err != nil {
 		log.Fatal("Error reading go.mod:", err)
 	}
 
-	mainContent, err := os.ReadFile("main.go")
+	mainContent, err := os.ReadFile(filepath.Join(dir, "main.go"))
 	if err != nil {
 		log.Fatal("Error reading main.go:", err)
 	}
@@ -987,34 +1221,63 @@ func dependenciesNeedUpdate() bool {
 	return false
 }
 
-func calculateCost(response openai.ChatCompletionResponse, inputTokens int) float64 {
-	var outputTokens int
-	var cost float64
+func (s *Session) record(usage Usage, cost float64) {
+	s.InputTokens += usage.InputTokens
+	s.OutputTokens += usage.OutputTokens
+	s.CachedInputTokens += usage.CachedInputTokens
+	if usage.CachedInputTokens > 0 {
+		s.PromptCacheHits++
+	}
+	s.TotalCost += cost
+}
+
+func calculateCost(model string, usage Usage) float64 {
+	// A cost reported by the backend (OpenRouter) beats our own calculation
+	if usage.Cost > 0 {
+		return usage.Cost
+	}
+
+	price, ok := findPrice(model)
+	if !ok {
+		// Unknown models are not counted rather than guessed at
+		if !warnedModels[model] {
+			warnedModels[model] = true
+			log.Printf("Warning: no pricing known for model %s, its cost is not included in the session total", model)
+		}
+		return 0
+	}
 
-	// Count output tokens
-	outputTokens = len(response.Choices[0].Message.Content)
+	cachedPrice := price.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = price.Input
+	}
 
-	// Calculate cost based on model
-	switch response.Model {
-	case "claude-3-sonnet-20240229":
-		cost = (float64(inputTokens) * 3.0 / 1e6) + (float64(outputTokens) * 15.0 / 1e6)
-	case "claude-3-haiku-20240307":
-		cost = (float64(inputTokens) * 0.25 / 1e6) + (float64(outputTokens) * 1.25 / 1e6)
-	default:
-		// Default cost calculation if model is not recognized
-		cost = 0.01
+	cacheWritePrice := price.CacheWrite
+	if cacheWritePrice == 0 {
+		cacheWritePrice = price.Input
 	}
 
-	return cost
+	uncachedTokens := usage.InputTokens - usage.CachedInputTokens - usage.CacheWriteTokens
+	return (float64(uncachedTokens) * price.Input / 1e6) +
+		(float64(usage.CachedInputTokens) * cachedPrice / 1e6) +
+		(float64(usage.CacheWriteTokens) * cacheWritePrice / 1e6) +
+		(float64(usage.OutputTokens) * price.Output / 1e6)
 }
 
-func parseChanges(config Config, rawChanges string) []FileContent {
+// extractChanges reads the changes in a reply, repairing what it can. The
+// split order is left alone, as the changes may not be applied to this tree.
+func extractChanges(ctx context.Context, config Config, rawChanges string) []FileContent {
 	var changes []FileContent
 
+	// a reply in the structured output format needs no repair
+	if structured, ok := parseStructuredChanges(rawChanges); ok {
+		return structured
+	}
+
 	// first let's just try the naive way
 	err := json.Unmarshal([]byte(rawChanges), &changes)
 	if err == nil {
-		return processLocations(changes)
+		return changes
 	}
 
 	start := strings.Index(rawChanges, "[")
@@ -1066,11 +1329,35 @@ func parseChanges(config Config, rawChanges string) []FileContent {
 
 	// If there are more changes to process, recursively call generateChanges
 	if len(validJSONString) < len(rawJSON) {
-		additionalChanges := generateAdditionalChanges(config, changes, rawJSON[len(validJSONString):])
+		additionalChanges, err := generateAdditionalChanges(ctx, config, changes, rawJSON[len(validJSONString):])
+		if err != nil {
+			// the next request will stop the run
+			log.Printf("Warning: %v; keeping the changes read so far", err)
+		}
 		changes = append(changes, additionalChanges...)
 	}
 
-	return processLocations(changes)
+	return changes
+}
+
+// responseChanges returns the changes in a reply, taken from its tool calls
+// in tool mode. The split order is not updated yet.
+func responseChanges(ctx context.Context, config Config, response ChatResponse) []FileContent {
+	if config.ToolMode {
+		return changesFromToolCalls(".", response.ToolCalls)
+	}
+	return extractChanges(ctx, config, response.Content)
+}
+
+// noChanges reports whether reply is a well-formed empty list of changes, a
+// bare [] or a structured {"changes": []}, as opposed to a reply no changes
+// could be read from.
+func noChanges(reply string) bool {
+	if changes, ok := parseStructuredChanges(reply); ok {
+		return len(changes) == 0
+	}
+	var changes []FileContent
+	return json.Unmarshal([]byte(reply), &changes) == nil && changes != nil && len(changes) == 0
 }
 
 func getFirstKeyword(s string) string {
@@ -1112,10 +1399,11 @@ func readGoPartFiles(dir string) []FileContent {
 	return files
 }
 
-func ensureGoimportsInstalled() {
-	cmd := exec.Command("go", "install", "golang.org/x/tools/cmd/goimports@latest")
+func ensureGoimportsInstalled(ctx context.Context) {
+	cmd := exec.CommandContext(ctx, "go", "install", "golang.org/x/tools/cmd/goimports@latest")
 	err := cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Fatal("Failed to install goimports:", err)
 	}
 }
@@ -1150,106 +1438,176 @@ func splitGoFiles(fileList string) {
 	}
 }
 
-func removeAndCleanup(branchName string) {
+func removeAndCleanup(ctx context.Context, branchName string) {
 	if branchName == "main" {
 		log.Fatal("Cannot delete main branch.")
 	}
-	cmd := exec.Command("git", "stash")
+	cmd := exec.CommandContext(ctx, "git", "stash")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Fatal("Error while stashing changes:", string(output), err)
 	}
 	// Checkout main
-	cmd = exec.Command("git", "checkout", "main")
+	cmd = exec.CommandContext(ctx, "git", "checkout", "main")
 	output, err = cmd.CombinedOutput()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Fatal("Error checking out main branch:", string(output), err)
 	}
 
 	// Delete the branch
-	cmd = exec.Command("git", "branch", "-D", branchName)
+	cmd = exec.CommandContext(ctx, "git", "branch", "-D", branchName)
 	err = cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		log.Fatal("Error deleting branch:", err)
 	}
 
+	deleteConversation(branchName)
 	fmt.Printf("Branch %s deleted and moved back to main branch.\n", branchName)
 }
 
-func (w *WrappedOpenAIClient) CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (*openai.ChatCompletionStream, error) {
-	stream, err := w.client.CreateChatCompletionStream(ctx, request)
-	if err == nil {
-		currentSession.Requests++
-		// Note: Cost calculation for streaming responses might need to be handled differently
-	}
-	return stream, err
-}
-
-func generateChanges(config Config, files []FileContent) []FileContent {
+// generateChanges asks the model for the changes to files. The only error it
+// returns is running out of budget; others end the run.
+func generateChanges(ctx context.Context, config Config, files []FileContent) ([]FileContent, error) {
 	fmt.Println("Generating changes...")
 
-	client := createOpenAIClient(config)
+	client := createProvider(config)
 
-	promptFile := config.ChangesPrompt
-	if promptFile == "" {
-		if config.NoGopart {
-			promptFile = "prompts/changes_no_goparts.txt"
-		} else {
-			promptFile = "prompts/changes_goparts.txt"
-		}
+	promptFile := "prompts/changes_goparts.txt"
+	if config.NoGopart {
+		promptFile = "prompts/changes_no_goparts.txt"
 	}
 
-	promptContent := getPromptContent(promptFile, promptFile)
-	tmpl, err := template.New("changes").Parse(promptContent)
+	promptContent := getPromptContent(config.ChangesPrompt, promptFile)
+	tmpl, err := parsePromptTemplate("changes", promptContent)
 	if err != nil {
 		log.Fatal(err, "in generateChanges: template parsing")
 	}
 
-	filesJSON, _ := json.Marshal(files)
-	var promptBuffer bytes.Buffer
-	err = tmpl.Execute(&promptBuffer, map[string]string{
+	var history []ChatMessage
+	data := promptData(ctx, tmpl.fields(), map[string]string{
 		"Prompt":      config.Prompt,
-		"Files":       string(filesJSON),
 		"ProjectName": config.ProjectName,
+		"RepoMap":     "",
+		"Structured":  "",
 	})
+	var tools []Tool
+	var format *ResponseFormat
+	if config.ToolMode {
+		tools = fileTools(config)
+	} else if supportsStructuredOutput(config) {
+		// the prompt asks for the changes in the same shape as the schema
+		format = changesFormat
+		data["Structured"] = "true"
+	}
+	render := func(files []FileContent) []ChatMessage {
+		filesJSON, _ := json.Marshal(files)
+		data["Files"] = string(filesJSON)
+		messages, err := tmpl.messages(data, history)
+		if err != nil {
+			log.Fatal(err, "in generateChanges: template execution")
+		}
+		return addConventions(messages, tmpl.fields())
+	}
+
+	models, reason := routeModels(config, len(files))
+	fmt.Printf("Routing to %s: %s\n", models[0], reason)
+
+	// With a repo map only the files likely to change are sent in full
+	projectFiles := files
+	if config.RepoMap.Enabled {
+		repoMap, full := buildRepoMap(files, repoMapSources(config), config.Prompt, config.RepoMap.Bodies)
+		if repoMap == "" {
+			fmt.Println("Nothing in the project matches the prompt, sending all files instead of a repo map")
+		} else {
+			fmt.Printf("Repo map takes %d tokens; sending %d of %d files in full\n", countTokens(models[0], repoMap), len(full), len(files))
+			data["RepoMap"] = repoMap
+			files = full
+		}
+	}
+
+	// Earlier prompts on this branch go first, taking at most a share of
+	// what is left for the files
+	budget, err := contextBudget(config, models, countMessageTokens(models[0], render(nil)))
 	if err != nil {
-		log.Fatal(err, "in generateChanges: template execution")
-	}
-
-	stream, err := client.CreateChatCompletionStream(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: config.OrHigh,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: promptBuffer.String(),
-				},
-			},
-		},
-	)
+		log.Fatalf("Error in generateChanges: %v", err)
+	}
+	historyTokens := config.HistoryTokens
+	if share := budget / historyShare; share < historyTokens {
+		historyTokens = share
+	}
+	if err := currentConversation.compact(ctx, config, historyTokens); err != nil {
+		return nil, err
+	}
+	history = currentConversation.messages(models[0], historyTokens)
 
+	// Leave out what doesn't fit in the context window of the models
+	budget, err = contextBudget(config, models, countMessageTokens(models[0], render(nil)))
 	if err != nil {
-		log.Fatal(err, "in generateChanges")
+		log.Fatalf("Error in generateChanges: %v", err)
 	}
-	defer stream.Close()
+	files = packFiles(files, config.Prompt, models[0], budget)
 
-	var fullResponse strings.Builder
-	for {
-		response, err := stream.Recv()
-		if errors.Is(err, io.EOF) {
-			break
-		}
+	messages := render(files)
+	if config.ToolMode {
+		messages = insertSystemMessage(messages, getPromptContent("", "prompts/tool_mode.txt"))
+	}
+
+	var changes []FileContent
+	if config.Candidates.Count > 1 {
+		changes, err = bestCandidate(ctx, config, client, models, ChatRequest{Messages: messages, Tools: tools, ResponseFormat: format})
 		if err != nil {
-			log.Fatal("Stream error:", err)
+			return nil, err
 		}
-		fullResponse.WriteString(response.Choices[0].Delta.Content)
-		fmt.Print(response.Choices[0].Delta.Content)
-	}
+	} else {
+		send := func(request ChatRequest) (ChatResponse, error) {
+			response, err := streamCompletion(ctx, client, request)
+			if response.FinishReason == "tool_calls" {
+				fmt.Println()
+			}
+			return response, err
+		}
+		for i, model := range models {
+			response, err := completeWithTools(".", ChatRequest{Model: model, Messages: messages, Tools: tools, ResponseFormat: format}, send)
+			if err != nil {
+				exitIfInterrupted(ctx)
+				if errors.Is(err, ErrBudgetExceeded) {
+					return nil, err
+				}
+				if fallBack(models, i, config.Fallback.OnError, fmt.Sprintf("failed (%v)", err)) {
+					continue
+				}
+				log.Fatal(err, "in generateChanges")
+			}
+			if response.FinishReason == "length" && fallBack(models, i, config.Fallback.OnLength, "ran out of tokens") {
+				continue
+			}
+			content := response.Content
+
+			if config.ToolMode {
+				// the reply is in the tool calls
+				fmt.Println()
+			} else {
+				fmt.Println("\nRaw changes suggestion:", content)
+			}
+			changes = responseChanges(ctx, config, response)
+			if len(changes) == 0 && !noChanges(content) && fallBack(models, i, config.Fallback.OnInvalidJSON, "returned no usable changes") {
+				continue
+			}
 
-	fmt.Println("\nRaw changes suggestion:", fullResponse.String())
+			currentSession.ChangesModel = model
+			fmt.Println("Changes generated by", model)
+			break
+		}
+	}
 
-	changes := parseChanges(config, fullResponse.String())
+	changes = processLocations(".", changes)
+	if config.RepoMap.Enabled {
+		changes = restoreBodies(changes, projectFiles)
+	}
+	currentConversation.addTurn(turnPrompt(config), changes)
 
 	// Check if there are more than 10 new files
 	newFileCount := 0
@@ -1269,116 +1627,120 @@ func generateChanges(config Config, files []FileContent) []FileContent {
 	// })
 	// // }
 
-	return changes
+	return changes, nil
 }
 
-func (w *WrappedOpenAIClient) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
-	response, err := w.client.CreateChatCompletion(ctx, request)
-	if err == nil {
-		currentSession.Requests++
-		inputTokens := len(request.Messages[len(request.Messages)-1].Content)
-		currentSession.TotalCost += calculateCost(response, inputTokens)
+func updateDependencies(ctx context.Context) {
+	if err := syncDependencies(ctx, "."); err != nil {
+		exitIfInterrupted(ctx)
+		log.Fatalf("Error %v", err)
 	}
-	return response, err
 }
 
-func updateDependencies() {
-	if dependenciesNeedUpdate() {
-		fmt.Println("Updating dependencies...")
-		runGoGet()
-		runGoModTidy()
-	} else {
+// syncDependencies runs go get and go mod tidy in the project in dir when
+// main.go imports packages that are not in go.mod.
+func syncDependencies(ctx context.Context, dir string) error {
+	if !dependenciesNeedUpdate(dir) {
 		fmt.Println("Dependencies are up to date.")
+		return nil
+	}
+	fmt.Println("Updating dependencies...")
+	if err := runGoGet(ctx, dir); err != nil {
+		return err
 	}
+	return runGoModTidy(ctx, dir)
 }
 
-func fixTests(config Config) {
-	cmd := exec.Command("make", "test")
+func fixTests(ctx context.Context, config Config) error {
+	cmd := exec.CommandContext(ctx, "make", "test")
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
 	err := cmd.Run()
 	if err != nil {
+		exitIfInterrupted(ctx)
 		fmt.Println("Tests failed. Error output:")
 		fmt.Println(stdout.String())
 		fmt.Println(stderr.String())
 
 		// Generate a prompt to fix the failing tests
 		promptContent := getPromptContent(config.FixJsonPrompt, "prompts/fix_tests.txt")
-		tmpl, err := template.New("fixtests").Parse(promptContent)
+		tmpl, err := parsePromptTemplate("fixtests", promptContent)
 		if err != nil {
 			log.Fatal(err, "in fixTests: template parsing")
 		}
 
-		var promptBuffer bytes.Buffer
-		err = tmpl.Execute(&promptBuffer, map[string]string{
+		prompt, err := tmpl.text(promptData(ctx, tmpl.fields(), map[string]string{
 			"TestErrors":  stdout.String() + "\n" + stderr.String(),
 			"ProjectName": config.ProjectName,
-		})
+		}))
 		if err != nil {
 			log.Fatal(err, "in fixTests: template execution")
 		}
 
 		// Use the generated prompt to fix the failing tests
-		config.Prompt = promptBuffer.String()
+		config.Prompt = prompt
+		config.Task = taskTestRepair
 		files := readGoPartFiles("editor")
-		changes := generateChanges(config, files)
-		applyChanges(changes)
+		changes, err := generateChanges(ctx, config, files)
+		if err != nil {
+			return err
+		}
+		applyChanges(ctx, ".", changes)
 
 		// Attempt to run tests again
-		cmd = exec.Command("make", "test")
+		cmd = exec.CommandContext(ctx, "make", "test")
 		err = cmd.Run()
 		if err != nil {
+			exitIfInterrupted(ctx)
 			// If tests still fail, recursively call fixTests
-			fixTests(config)
-		} else {
-			fmt.Println("All tests passed after fixes.")
+			return fixTests(ctx, config)
 		}
+		fmt.Println("All tests passed after fixes.")
 	} else {
 		fmt.Println("All tests passed. No fixes needed.")
 	}
+	return nil
 }
 
-func generateBranchName(config Config, files []FileContent) string {
-	client := createOpenAIClient(config)
+func generateBranchName(ctx context.Context, config Config, files []FileContent) (string, error) {
+	client := createProvider(config)
 	currentBranch := getCurrentBranch()
 
 	promptContent := getPromptContent(config.BranchPrompt, "prompts/branch_name.txt")
-	tmpl, err := template.New("branch").Parse(promptContent)
+	tmpl, err := parsePromptTemplate("branch", promptContent)
 	if err != nil {
 		log.Fatal(err, "in generateBranchName: template parsing")
 	}
 
-	var promptBuffer bytes.Buffer
-	err = tmpl.Execute(&promptBuffer, map[string]string{
+	messages, err := tmpl.messages(promptData(ctx, tmpl.fields(), map[string]string{
 		"Prompt":        config.Prompt,
 		"CurrentBranch": currentBranch,
-	})
+	}), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: config.OrLow,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: promptBuffer.String(),
-				},
-			},
-		},
+	resp, err := complete(
+		ctx,
+		client,
+		config,
+		roleLow,
+		messages,
 	)
 
 	if err != nil {
+		exitIfInterrupted(ctx)
+		if errors.Is(err, ErrBudgetExceeded) {
+			return "", err
+		}
 		log.Fatal(err, resp, "in generateBranchName")
 	}
 
-	fmt.Println("branch name suggestion: ", resp.Choices[0].Message.Content)
+	fmt.Println("branch name suggestion: ", resp.Content)
 
-	return strings.TrimSpace(resp.Choices[0].Message.Content)
+	return strings.TrimSpace(resp.Content), nil
 }
 
 func checkGoVersion() {
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// WrappedOpenAIClient is the Provider for OpenAI compatible endpoints
+// (OpenAI, OpenRouter, ...).
+type WrappedOpenAIClient struct {
+	client         *openai.Client
+	transport      *retryAfterTransport
+	baseURL        string
+	token          string
+	openRouter     bool
+	openRouterCost bool
+}
+
+type openAIStream struct {
+	client *WrappedOpenAIClient
+	stream *openai.ChatCompletionStream
+	ctx    context.Context
+	extra  *openRouterRequest
+	id     string
+	usage  Usage
+}
+
+func newOpenAIClient(config Config) *WrappedOpenAIClient {
+	transport := &retryAfterTransport{base: http.DefaultTransport}
+	_config := openai.DefaultConfig(config.OrToken)
+	_config.BaseURL = config.OrBase
+	_config.HTTPClient = &http.Client{Transport: &openRouterTransport{base: transport}}
+	client := openai.NewClientWithConfig(_config)
+
+	return &WrappedOpenAIClient{
+		client:         client,
+		transport:      transport,
+		baseURL:        strings.TrimSuffix(strings.TrimSuffix(config.OrBase, "/"), "/chat/completions"),
+		token:          config.OrToken,
+		openRouter:     isOpenRouter(config.OrBase),
+		openRouterCost: config.OpenRouterCost,
+	}
+}
+
+// generationCost asks OpenRouter what a generation actually cost. The stats
+// show up shortly after the request finishes, so we try a few times.
+func (w *WrappedOpenAIClient) generationCost(ctx context.Context, id string) (float64, error) {
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, time.Duration(attempt)*500*time.Millisecond); err != nil {
+				return 0, err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.baseURL+"/generation?id="+url.QueryEscape(id), nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+w.token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var stats struct {
+			Data struct {
+				TotalCost float64 `json:"total_cost"`
+			} `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&stats)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("generation stats for %s: status %d", id, resp.StatusCode)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return stats.Data.TotalCost, nil
+	}
+	return 0, lastErr
+}
+
+// addGenerationCost fills in the cost OpenRouter reports, when asked to: the
+// one in the response, which extra has when it came from OpenRouter, or else
+// the one in the stats of the generation.
+func (w *WrappedOpenAIClient) addGenerationCost(ctx context.Context, extra *openRouterRequest, id string, usage *Usage) {
+	if !w.openRouterCost {
+		return
+	}
+	if extra != nil && extra.cost != nil {
+		usage.Cost = *extra.cost
+		return
+	}
+	if id == "" {
+		return
+	}
+	cost, err := w.generationCost(ctx, id)
+	if err != nil {
+		log.Printf("Warning: could not get generation cost from OpenRouter: %v", err)
+		return
+	}
+	usage.Cost = cost
+}
+
+// wrapError turns go-openai's HTTP errors into a ProviderError so they can be
+// retried.
+func (w *WrappedOpenAIClient) wrapError(err error) error {
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	status := 0
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.HTTPStatusCode
+	case errors.As(err, &reqErr):
+		status = reqErr.HTTPStatusCode
+	}
+	if status == 0 {
+		return err
+	}
+	return &ProviderError{StatusCode: status, RetryAfter: w.transport.retryAfter(), Err: err}
+}
+
+func toOpenAIRequest(request ChatRequest) openai.ChatCompletionRequest {
+	messages := make([]openai.ChatCompletionMessage, 0, len(request.Messages))
+	for _, m := range request.Messages {
+		message := openai.ChatCompletionMessage{Role: m.Role, Content: m.Content, ToolCallID: m.ToolCallID}
+		for _, call := range m.ToolCalls {
+			message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+				ID:       call.ID,
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: call.Name, Arguments: call.Arguments},
+			})
+		}
+		messages = append(messages, message)
+	}
+	result := openai.ChatCompletionRequest{
+		Model:       request.Model,
+		Messages:    messages,
+		Temperature: request.Temperature,
+	}
+	if request.ResponseFormat != nil {
+		result.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   request.ResponseFormat.Name,
+				Schema: request.ResponseFormat.Schema,
+				Strict: true,
+			},
+		}
+	}
+	for _, tool := range request.Tools {
+		result.Tools = append(result.Tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	return result
+}
+
+func fromOpenAIToolCalls(calls []openai.ToolCall) []ToolCall {
+	var result []ToolCall
+	for i, call := range calls {
+		index := i
+		if call.Index != nil {
+			index = *call.Index
+		}
+		result = append(result, ToolCall{Index: index, ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments})
+	}
+	return result
+}
+
+// requestContext carries what OpenRouter needs beyond the go-openai request,
+// see openRouterTransport. The returned openRouterRequest, nil for other
+// providers, has the cost once the response is read.
+func (w *WrappedOpenAIClient) requestContext(ctx context.Context, request ChatRequest) (context.Context, *openRouterRequest) {
+	if !w.openRouter {
+		return ctx, nil
+	}
+	return withOpenRouterRequest(ctx, request, w.openRouterCost)
+}
+
+func (w *WrappedOpenAIClient) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	requestCtx, extra := w.requestContext(ctx, request)
+	response, err := w.client.CreateChatCompletion(requestCtx, toOpenAIRequest(request))
+	if err != nil {
+		return ChatResponse{}, w.wrapError(err)
+	}
+
+	result := ChatResponse{
+		Model: response.Model,
+		Usage: fromOpenAIUsage(response.Usage),
+	}
+	if len(response.Choices) > 0 {
+		result.Content = response.Choices[0].Message.Content
+		result.ToolCalls = fromOpenAIToolCalls(response.Choices[0].Message.ToolCalls)
+		result.FinishReason = string(response.Choices[0].FinishReason)
+	}
+	w.addGenerationCost(ctx, extra, response.ID, &result.Usage)
+	return result, nil
+}
+
+func fromOpenAIUsage(usage openai.Usage) Usage {
+	result := Usage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+	}
+	if usage.PromptTokensDetails != nil {
+		result.CachedInputTokens = usage.PromptTokensDetails.CachedTokens
+	}
+	return result
+}
+
+func (w *WrappedOpenAIClient) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	openAIRequest := toOpenAIRequest(request)
+	// ask for a final chunk with the usage of the whole request
+	openAIRequest.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+
+	requestCtx, extra := w.requestContext(ctx, request)
+	stream, err := w.client.CreateChatCompletionStream(requestCtx, openAIRequest)
+	if err != nil {
+		return nil, w.wrapError(err)
+	}
+	return &openAIStream{client: w, stream: stream, ctx: ctx, extra: extra}, nil
+}
+
+func (s *openAIStream) Recv() (ChatStreamChunk, error) {
+	response, err := s.stream.Recv()
+	if errors.Is(err, io.EOF) {
+		s.client.addGenerationCost(s.ctx, s.extra, s.id, &s.usage)
+		return ChatStreamChunk{}, err
+	}
+	if err != nil {
+		return ChatStreamChunk{}, s.client.wrapError(err)
+	}
+	s.id = response.ID
+	if response.Usage != nil {
+		s.usage = fromOpenAIUsage(*response.Usage)
+	}
+
+	var chunk ChatStreamChunk
+	if len(response.Choices) > 0 {
+		chunk.Content = response.Choices[0].Delta.Content
+		chunk.ToolCalls = fromOpenAIToolCalls(response.Choices[0].Delta.ToolCalls)
+		chunk.FinishReason = string(response.Choices[0].FinishReason)
+	}
+	return chunk, nil
+}
+
+func (s *openAIStream) Usage() Usage {
+	return s.usage
+}
+
+func (s *openAIStream) Close() error {
+	return s.stream.Close()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIStream(t *testing.T) {
+	events := []string{
+		`{"id":"gen-1","model":"openai/gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"Writing"}}]}`,
+		`{"id":"gen-1","model":"openai/gpt-4o","choices":[{"index":0,"delta":{"content":" a.go"}}]}`,
+		`{"id":"gen-1","model":"openai/gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"write_file","arguments":""}}]}}]}`,
+		`{"id":"gen-1","model":"openai/gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"filepath\":"}}]}}]}`,
+		`{"id":"gen-1","model":"openai/gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"a.go\"}"}}]}}]}`,
+		`{"id":"gen-1","model":"openai/gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		`{"id":"gen-1","model":"openai/gpt-4o","choices":[],"usage":{"prompt_tokens":120,"completion_tokens":15,"prompt_tokens_details":{"cached_tokens":100}}}`,
+		`[DONE]`,
+	}
+	var request map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat/completions" {
+			t.Errorf("request to %s, want /chat/completions", r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			fmt.Fprintf(w, "data: %s\n\n", event)
+		}
+	}))
+	defer server.Close()
+
+	client := newOpenAIClient(Config{OrBase: server.URL, OrToken: "test"})
+	stream, err := client.CreateChatCompletionStream(context.Background(), ChatRequest{
+		Model:    "openai/gpt-4o",
+		Messages: []ChatMessage{{Role: RoleUser, Content: "write a.go"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	var content strings.Builder
+	var calls []ToolCall
+	var finishReason string
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content.WriteString(chunk.Content)
+		calls = addToolCalls(calls, chunk.ToolCalls)
+		if chunk.FinishReason != "" {
+			finishReason = chunk.FinishReason
+		}
+	}
+
+	if got := content.String(); got != "Writing a.go" {
+		t.Errorf("content = %q, want %q", got, "Writing a.go")
+	}
+	wantCalls := []ToolCall{{Index: 0, ID: "call_1", Name: "write_file", Arguments: `{"filepath":"a.go"}`}}
+	if !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("tool calls = %+v, want %+v", calls, wantCalls)
+	}
+	if finishReason != "tool_calls" {
+		t.Errorf("finish reason = %q, want tool_calls", finishReason)
+	}
+	wantUsage := Usage{InputTokens: 120, OutputTokens: 15, CachedInputTokens: 100}
+	if usage := stream.Usage(); usage != wantUsage {
+		t.Errorf("usage = %+v, want %+v", usage, wantUsage)
+	}
+	if options, _ := request["stream_options"].(map[string]any); options["include_usage"] != true {
+		t.Errorf("stream_options = %v, want the usage included", request["stream_options"])
+	}
+}
+
+func TestOpenRouterRequest(t *testing.T) {
+	var request map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&request)
+		fmt.Fprint(w, `{"id":"gen-1","model":"anthropic/claude-sonnet-4","choices":[{"index":0,"message":{"role":"assistant","content":"[]"},"finish_reason":"stop"}],"usage":{"prompt_tokens":50,"completion_tokens":1,"cost":0.0042}}`)
+	}))
+	defer server.Close()
+
+	// the base URL only has to look like OpenRouter's
+	client := newOpenAIClient(Config{OrBase: server.URL + "/openrouter.ai/api/v1", OrToken: "test", OpenRouterCost: true})
+	response, err := client.CreateChatCompletion(context.Background(), ChatRequest{
+		Model: "anthropic/claude-sonnet-4",
+		Messages: []ChatMessage{
+			{Role: RoleSystem, Content: "instructions and files", Cache: true},
+			{Role: RoleUser, Content: "the prompt"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Usage.Cost != 0.0042 {
+		t.Errorf("cost = %v, want the 0.0042 of the response", response.Usage.Cost)
+	}
+	if usage, _ := request["usage"].(map[string]any); usage["include"] != true {
+		t.Errorf("usage = %v, want usage accounting asked for", request["usage"])
+	}
+	messages, _ := request["messages"].([]any)
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(messages))
+	}
+	wantCached := []any{map[string]any{
+		"type":          "text",
+		"text":          "instructions and files",
+		"cache_control": map[string]any{"type": "ephemeral"},
+	}}
+	if content := messages[0].(map[string]any)["content"]; !reflect.DeepEqual(content, wantCached) {
+		t.Errorf("cached message content = %v, want %v", content, wantCached)
+	}
+	if content := messages[1].(map[string]any)["content"]; content != "the prompt" {
+		t.Errorf("uncached message content = %v, want it left as text", content)
+	}
+}
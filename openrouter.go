@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// openRouterRequest is what a request to OpenRouter needs beyond the fields
+// go-openai knows about, and what its response has beyond them. It travels
+// with the request in its context.
+type openRouterRequest struct {
+	cached []int    // messages to put a cache breakpoint on
+	usage  bool     // ask for the cost along with the usage
+	stream bool     // the response is a stream of events
+	cost   *float64 // the cost in the response, nil until seen
+}
+
+type openRouterRequestKey struct{}
+
+func isOpenRouter(baseURL string) bool {
+	return strings.Contains(baseURL, "openrouter.ai")
+}
+
+// openRouterCacheControl reports whether the models behind model need
+// explicit cache breakpoints. OpenRouter's other providers cache the start
+// of a request by themselves.
+func openRouterCacheControl(model string) bool {
+	return strings.HasPrefix(model, "anthropic/") || strings.HasPrefix(model, "google/gemini")
+}
+
+// withOpenRouterRequest puts what request needs beyond the go-openai request
+// in ctx, for openRouterTransport. With cost set, the response is to carry
+// the cost of the request, which the returned openRouterRequest gets.
+func withOpenRouterRequest(ctx context.Context, request ChatRequest, cost bool) (context.Context, *openRouterRequest) {
+	extra := &openRouterRequest{usage: cost}
+	if openRouterCacheControl(request.Model) {
+		for i, m := range request.Messages {
+			if m.Cache {
+				extra.cached = append(extra.cached, i)
+			}
+		}
+	}
+	return context.WithValue(ctx, openRouterRequestKey{}, extra), extra
+}
+
+// openRouterTransport adds the extra of the request context to the body of
+// a request: cached messages are sent as a content part with a cache
+// control, as OpenRouter wants for Anthropic and Gemini models, and usage
+// accounting is turned on when the cost is wanted. The cost is then read
+// from the response as it passes by.
+type openRouterTransport struct {
+	base http.RoundTripper
+}
+
+func (t *openRouterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	extra, ok := req.Context().Value(openRouterRequestKey{}).(*openRouterRequest)
+	if !ok || req.Body == nil || (len(extra.cached) == 0 && !extra.usage) {
+		return t.base.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if body, err = extra.rewrite(body); err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || !extra.usage || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	if extra.stream {
+		resp.Body = &costReader{ReadCloser: resp.Body, request: extra}
+		return resp, nil
+	}
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	extra.readCost(body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// rewrite turns the content of the cached messages in a chat completion
+// request body into a text part with a cache control, and asks for the cost
+// when wanted.
+func (r *openRouterRequest) rewrite(body []byte) ([]byte, error) {
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	// absent for requests that aren't streamed
+	json.Unmarshal(payload["stream"], &r.stream)
+	if r.usage {
+		payload["usage"] = json.RawMessage(`{"include":true}`)
+	}
+	if len(r.cached) == 0 {
+		return json.Marshal(payload)
+	}
+
+	var messages []map[string]any
+	if err := json.Unmarshal(payload["messages"], &messages); err != nil {
+		return nil, err
+	}
+	for _, i := range r.cached {
+		if i >= len(messages) {
+			continue
+		}
+		if content, ok := messages[i]["content"].(string); ok {
+			messages[i]["content"] = []map[string]any{{
+				"type":          "text",
+				"text":          content,
+				"cache_control": map[string]string{"type": "ephemeral"},
+			}}
+		}
+	}
+
+	var err error
+	if payload["messages"], err = json.Marshal(messages); err != nil {
+		return nil, err
+	}
+	return json.Marshal(payload)
+}
+
+// readCost takes the cost from the usage in a response body or a stream
+// event, if it has one.
+func (r *openRouterRequest) readCost(data []byte) {
+	var response struct {
+		Usage *struct {
+			Cost *float64 `json:"cost"`
+		} `json:"usage"`
+	}
+	if json.Unmarshal(data, &response) == nil && response.Usage != nil && response.Usage.Cost != nil {
+		r.cost = response.Usage.Cost
+	}
+}
+
+// costReader passes a streamed response through, reading the cost from the
+// event with the usage as it goes by.
+type costReader struct {
+	io.ReadCloser
+	request *openRouterRequest
+	line    []byte
+}
+
+func (c *costReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	data := p[:n]
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			c.line = append(c.line, data...)
+			return n, err
+		}
+		c.line = append(c.line, data[:i]...)
+		event, ok := bytes.CutPrefix(bytes.TrimSpace(c.line), []byte("data:"))
+		if ok && bytes.Contains(event, []byte(`"cost"`)) {
+			c.request.readCost(event)
+		}
+		c.line = c.line[:0]
+		data = data[i+1:]
+	}
+}
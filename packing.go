@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultContextWindow = 32768
+	maxOutputReserve     = 8192
+)
+
+var identifierPattern = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+// promptStopWords are left out when matching the prompt against files; they
+// show up everywhere and say nothing about relevance.
+var promptStopWords = map[string]bool{
+	"this": true, "that": true, "with": true, "from": true, "file": true, "files": true,
+	"code": true, "function": true, "make": true, "should": true, "have": true, "when": true,
+	"into": true, "then": true, "them": true, "they": true, "what": true, "which": true,
+	"would": true, "there": true, "also": true, "only": true, "some": true, "more": true,
+	"than": true, "like": true, "please": true, "need": true, "want": true, "each": true,
+	"change": true, "changes": true, "sure": true, "does": true, "instead": true,
+}
+
+type packedFile struct {
+	file   FileContent
+	index  int // position in the project
+	score  int
+	tokens int
+}
+
+// contextBudget returns how many tokens the project files may take in a
+// request to models, next to a prompt of promptTokens. The smallest context
+// window of the models counts, as any of them may get the request. It fails
+// when the prompt leaves no room for any file.
+func contextBudget(config Config, models []string, promptTokens int) (int, error) {
+	window := config.ContextBudget
+	if window == 0 {
+		for _, model := range models {
+			w := contextWindow(model)
+			if w == 0 {
+				w = defaultContextWindow
+			}
+			if window == 0 || w < window {
+				window = w
+			}
+		}
+	}
+
+	reserve := window / 4
+	if reserve > maxOutputReserve {
+		reserve = maxOutputReserve
+	}
+	budget := window - reserve - promptTokens
+	if budget <= 0 {
+		return 0, fmt.Errorf("the prompt takes %d tokens, which leaves no room for the project files in a context window of %d tokens with %d kept for the answer; shorten the prompt or set -context-budget", promptTokens, window, reserve)
+	}
+	return budget, nil
+}
+
+// promptWords returns the identifiers in prompt worth matching, lowercased.
+func promptWords(prompt string) map[string]bool {
+	words := map[string]bool{}
+	for _, word := range identifierPattern.FindAllString(prompt, -1) {
+		word = strings.ToLower(word)
+		if len(word) >= 4 && !promptStopWords[word] {
+			words[word] = true
+		}
+	}
+	return words
+}
+
+// relevance scores how much file has to do with the prompt: a file (or, for
+// .gopart files, a function) named in the prompt scores high, and every
+// prompt word used in the file adds a point.
+func relevance(prompt string, words map[string]bool, file FileContent) int {
+	score := 0
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(file.FilePath), filepath.Ext(file.FilePath)))
+	if strings.Contains(strings.ToLower(prompt), strings.ToLower(file.FilePath)) || words[name] {
+		score += 100
+	}
+	return score + wordScore(words, file.Content)
+}
+
+// wordScore counts the distinct prompt words used in content.
+func wordScore(words map[string]bool, content string) int {
+	score := 0
+	seen := map[string]bool{}
+	for _, id := range identifierPattern.FindAllString(content, -1) {
+		id = strings.ToLower(id)
+		if words[id] && !seen[id] {
+			seen[id] = true
+			score++
+		}
+	}
+	return score
+}
+
+func fileTokens(model string, file FileContent) int {
+	content, _ := json.Marshal(file)
+	return countTokens(model, string(content))
+}
+
+// packFiles makes the files fit in budget tokens. Files are taken in order of
+// relevance to the prompt: in full while they fit, then Go files that are
+// somewhat relevant as signatures only, and the rest is left out. What was
+// shrunk or left out is reported. The files that are sent keep their order,
+// so the request starts the same way as the last one and hits the
+// provider's prompt cache.
+func packFiles(files []FileContent, prompt, model string, budget int) []FileContent {
+	words := promptWords(prompt)
+
+	var scored []packedFile
+	total := 0
+	for i, file := range files {
+		p := packedFile{file: file, index: i, score: relevance(prompt, words, file), tokens: fileTokens(model, file)}
+		scored = append(scored, p)
+		total += p.tokens
+	}
+	if total <= budget {
+		return files
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		if scored[i].score != scored[j].score {
+			return scored[i].score > scored[j].score
+		}
+		return scored[i].tokens < scored[j].tokens
+	})
+
+	var packed []packedFile
+	var shrunk, dropped []string
+	used := 0
+	for _, p := range scored {
+		if used+p.tokens <= budget {
+			packed = append(packed, p)
+			used += p.tokens
+			continue
+		}
+		if p.score > 0 {
+			if signatures, ok := goSignatures(p.file); ok {
+				small := FileContent{FilePath: p.file.FilePath, Content: signatures}
+				if tokens := fileTokens(model, small); used+tokens <= budget {
+					p.file = small
+					packed = append(packed, p)
+					used += tokens
+					shrunk = append(shrunk, p.file.FilePath)
+					continue
+				}
+			}
+		}
+		dropped = append(dropped, p.file.FilePath)
+	}
+
+	fmt.Printf("Project files take %d tokens, more than the %d that fit in the context of %s. Sending %d tokens.\n", total, budget, model, used)
+	if len(shrunk) > 0 {
+		fmt.Println("Shrunk to signatures:", strings.Join(shrunk, ", "))
+	}
+	if len(dropped) > 0 {
+		fmt.Println("Left out:", strings.Join(dropped, ", "))
+	}
+
+	sort.Slice(packed, func(i, j int) bool { return packed[i].index < packed[j].index })
+	var result []FileContent
+	for _, p := range packed {
+		result = append(result, p.file)
+	}
+	return result
+}
+
+// goSignatures returns a Go file (or .gopart fragment) with the function
+// bodies removed.
+func goSignatures(file FileContent) (string, bool) {
+	ext := filepath.Ext(file.FilePath)
+	if ext != ".go" && ext != ".gopart" {
+		return "", false
+	}
+
+	src := file.Content
+	wrapped := !strings.HasPrefix(strings.TrimSpace(src), "package ")
+	if wrapped {
+		src = "package p\n\n" + src
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file.FilePath, src, 0)
+	if err != nil {
+		return "", false
+	}
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			fn.Body = nil
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		return "", false
+	}
+	out := buf.String()
+	if wrapped {
+		out = strings.TrimLeft(strings.TrimPrefix(out, "package p\n"), "\n")
+	}
+	return "// Function bodies left out to save space. Don't rewrite this file without its full content.\n" + out, true
+}
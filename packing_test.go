@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPackFiles(t *testing.T) {
+	const model = "openai/gpt-4o"
+	retry := FileContent{FilePath: "retry.go", Content: "package main\n\nfunc backoff(attempt int) int {\n\treturn attempt * attempt\n}\n"}
+	client := FileContent{FilePath: "client.go", Content: "package main\n\n// the client sends requests\nfunc send() {}\n"}
+	notes := FileContent{FilePath: "notes.txt", Content: strings.Repeat("Unrelated release notes. ", 40)}
+	// a relevant file too big to send in full
+	big := FileContent{FilePath: "big.go", Content: "package main\n\nfunc backoff(n int) []int {\n" + strings.Repeat("\tx := []int{1, 2, 3, 4, 5, 6, 7, 8}\n\t_ = x\n", 40) + "\treturn nil\n}\n"}
+	bigSignatures, _ := goSignatures(big)
+
+	tokens := func(files ...FileContent) int {
+		total := 0
+		for _, file := range files {
+			total += fileTokens(model, file)
+		}
+		return total
+	}
+
+	tests := []struct {
+		name   string
+		files  []FileContent
+		budget int
+		want   []FileContent
+	}{
+		{
+			name:   "everything fits",
+			files:  []FileContent{notes, retry, client},
+			budget: tokens(notes, retry, client),
+			want:   []FileContent{notes, retry, client},
+		},
+		{
+			name:   "unrelated files are left out first, the order is kept",
+			files:  []FileContent{retry, notes, client},
+			budget: tokens(retry, client) + 5,
+			want:   []FileContent{retry, client},
+		},
+		{
+			name:   "the most relevant file goes first",
+			files:  []FileContent{client, retry},
+			budget: tokens(retry) + 5,
+			want:   []FileContent{retry},
+		},
+		{
+			name:   "relevant Go files are shrunk to signatures",
+			files:  []FileContent{big, notes},
+			budget: tokens(FileContent{FilePath: big.FilePath, Content: bigSignatures}) + 5,
+			want:   []FileContent{{FilePath: big.FilePath, Content: bigSignatures}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := packFiles(tt.files, "Make the retry backoff grow slower", model, tt.budget)
+			if !reflect.DeepEqual(got, tt.want) {
+				var paths []string
+				for _, file := range got {
+					paths = append(paths, file.FilePath)
+				}
+				t.Errorf("packFiles() = %v, want %d files", paths, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestContextBudget(t *testing.T) {
+	tests := []struct {
+		name         string
+		window       int // -context-budget, 0 for the default window
+		promptTokens int
+		want         int
+		err          bool
+	}{
+		{"default window", 0, 1000, defaultContextWindow - maxOutputReserve - 1000, false},
+		{"small window keeps a quarter for the answer", 4000, 1000, 4000 - 1000 - 1000, false},
+		{"prompt fills the window", 4000, 3000, 0, true},
+		{"prompt over the window", 4000, 5000, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := contextBudget(Config{ContextBudget: tt.window}, []string{"unknown/model"}, tt.promptTokens)
+			if (err != nil) != tt.err {
+				t.Fatalf("contextBudget() error = %v, want an error: %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("contextBudget() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+//go:embed pricing.json
+var defaultPricing []byte
+
+// ModelPrice is the price of a model in dollars per million tokens, and the
+// size of its context window. Model may contain wildcards (as in path.Match)
+// and is matched both against the full model name and against the part after
+// the last slash, so "gpt-4o*" also matches "openai/gpt-4o-2024-08-06".
+type ModelPrice struct {
+	Model         string  `json:"model"`
+	Input         float64 `json:"input"`
+	Output        float64 `json:"output"`
+	CachedInput   float64 `json:"cached_input,omitempty"`
+	CacheWrite    float64 `json:"cache_write,omitempty"`    // writing to the prompt cache, where that costs extra
+	ContextWindow int     `json:"context_window,omitempty"` // in tokens
+}
+
+type pricingFile struct {
+	Models []ModelPrice `json:"models"`
+}
+
+// modelPrices is searched in order; entries from a user pricing file come
+// before the embedded defaults.
+var modelPrices = mustParsePricing(defaultPricing)
+
+func mustParsePricing(content []byte) []ModelPrice {
+	prices, err := parsePricing(content)
+	if err != nil {
+		panic(err)
+	}
+	return prices
+}
+
+func parsePricing(content []byte) ([]ModelPrice, error) {
+	var file pricingFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	for _, p := range file.Models {
+		if _, err := path.Match(p.Model, ""); err != nil {
+			return nil, fmt.Errorf("invalid model pattern %q: %w", p.Model, err)
+		}
+	}
+	return file.Models, nil
+}
+
+// loadPricing puts the prices from a user pricing file in front of the
+// embedded defaults.
+func loadPricing(filename string) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	prices, err := parsePricing(content)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	modelPrices = append(prices, mustParsePricing(defaultPricing)...)
+	return nil
+}
+
+// findPrice returns the price for model. Exact matches win over wildcards;
+// otherwise the first matching pattern is used.
+func findPrice(model string) (ModelPrice, bool) {
+	return findModel(model, func(ModelPrice) bool { return true })
+}
+
+// contextWindow returns the context window of model, or 0 when unknown.
+// Entries without a context window are skipped.
+func contextWindow(model string) int {
+	p, _ := findModel(model, func(p ModelPrice) bool { return p.ContextWindow > 0 })
+	return p.ContextWindow
+}
+
+func findModel(model string, accept func(ModelPrice) bool) (ModelPrice, bool) {
+	base := model
+	if i := strings.LastIndex(model, "/"); i >= 0 {
+		base = model[i+1:]
+	}
+
+	for _, p := range modelPrices {
+		if (p.Model == model || p.Model == base) && accept(p) {
+			return p, true
+		}
+	}
+	for _, p := range modelPrices {
+		if !accept(p) {
+			continue
+		}
+		if ok, _ := path.Match(p.Model, model); ok {
+			return p, true
+		}
+		if ok, _ := path.Match(p.Model, base); ok {
+			return p, true
+		}
+	}
+	return ModelPrice{}, false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// usePrices replaces the pricing table for the test.
+func usePrices(t *testing.T, prices ...ModelPrice) {
+	saved, savedWarned := modelPrices, warnedModels
+	t.Cleanup(func() { modelPrices, warnedModels = saved, savedWarned })
+	modelPrices = prices
+	warnedModels = map[string]bool{}
+}
+
+func TestCalculateCost(t *testing.T) {
+	usePrices(t,
+		ModelPrice{Model: "gpt-4o*", Input: 2.5, Output: 10, CachedInput: 1.25},
+		ModelPrice{Model: "gpt-4o-mini", Input: 0.15, Output: 0.6},
+		ModelPrice{Model: "claude-*", Input: 3, Output: 15, CachedInput: 0.3, CacheWrite: 3.75},
+		ModelPrice{Model: "claude-opus-*", Input: 15, Output: 75},
+		ModelPrice{Model: "meta-llama/*", Input: 0.1, Output: 0.1},
+	)
+	million := Usage{InputTokens: 1e6, OutputTokens: 1e6}
+
+	tests := []struct {
+		name  string
+		model string
+		usage Usage
+		want  float64
+	}{
+		{name: "wildcard", model: "gpt-4o-2024-08-06", usage: million, want: 12.5},
+		{name: "exact match beats an earlier wildcard", model: "gpt-4o-mini", usage: million, want: 0.75},
+		{name: "wildcard after the provider prefix", model: "openai/gpt-4o-2024-08-06", usage: million, want: 12.5},
+		{name: "exact match after the provider prefix", model: "openai/gpt-4o-mini", usage: million, want: 0.75},
+		{name: "first matching wildcard wins", model: "claude-opus-4", usage: million, want: 18},
+		{name: "wildcard on the full name", model: "meta-llama/llama-3-70b", usage: million, want: 0.2},
+		{name: "unknown model", model: "mistral-large", usage: million, want: 0},
+		{name: "cached input", model: "gpt-4o", usage: Usage{InputTokens: 1e6, CachedInputTokens: 5e5}, want: 1.875},
+		{name: "cache writes", model: "claude-sonnet-4", usage: Usage{InputTokens: 1e6, CachedInputTokens: 2e5, CacheWriteTokens: 4e5}, want: 1.2 + 0.06 + 1.5},
+		{name: "cached input at the input price", model: "gpt-4o-mini", usage: Usage{InputTokens: 1e6, CachedInputTokens: 1e6}, want: 0.15},
+		{name: "reported cost", model: "gpt-4o", usage: Usage{InputTokens: 1e6, Cost: 0.42}, want: 0.42},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := calculateCost(tt.model, tt.usage); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("calculateCost(%s) = %v, want %v", tt.model, got, tt.want)
+			}
+		})
+	}
+	if !warnedModels["mistral-large"] {
+		t.Error("no warning about the unknown model")
+	}
+}
+
+func TestContextWindow(t *testing.T) {
+	usePrices(t,
+		ModelPrice{Model: "gpt-4o-mini", Input: 0.15, Output: 0.6},
+		ModelPrice{Model: "gpt-4o*", Input: 2.5, Output: 10, ContextWindow: 128000},
+	)
+	tests := []struct {
+		model string
+		want  int
+	}{
+		{model: "gpt-4o-mini", want: 128000}, // the exact match has no window
+		{model: "openai/gpt-4o", want: 128000},
+		{model: "o1", want: 0},
+	}
+	for _, tt := range tests {
+		if got := contextWindow(tt.model); got != tt.want {
+			t.Errorf("contextWindow(%s) = %d, want %d", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestLoadPricing(t *testing.T) {
+	usePrices(t)
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "pricing.json")
+	writeFile(t, valid, `{"models": [{"model": "claude-*", "input": 1, "output": 2}]}`)
+	invalid := filepath.Join(dir, "invalid.json")
+	writeFile(t, invalid, `{"models": [{"model": "claude-[", "input": 1, "output": 2}]}`)
+
+	if err := loadPricing(invalid); err == nil {
+		t.Error("loadPricing() accepted an invalid pattern")
+	}
+	if err := loadPricing(valid); err != nil {
+		t.Fatal(err)
+	}
+	// the user's prices come before the defaults
+	if got := calculateCost("claude-3-5-sonnet-20241022", Usage{InputTokens: 1e6}); got != 1 {
+		t.Errorf("calculateCost() = %v, want the price from the user file", got)
+	}
+	if len(modelPrices) <= 1 {
+		t.Error("the default prices were dropped")
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"text/template/parse"
+)
+
+// The places a prompt can come from, in increasing precedence.
+const (
+	layerEmbedded = "embedded"
+	layerUser     = "user"
+	layerProject  = "project"
+	layerFlag     = "flag"
+)
+
+// cacheBreak separates the part of a prompt template that is the same for
+// every request on a project (instructions and files) from the part that
+// varies (the prompt, build errors).
+const cacheBreak = "--- cache-break ---"
+
+// sectionRoles are the markers that start a section of a prompt template,
+// sent as a message of that role.
+var sectionRoles = map[string]string{
+	"--- system ---":    RoleSystem,
+	"--- user ---":      RoleUser,
+	"--- assistant ---": RoleAssistant,
+}
+
+// projectPromptDir holds prompt overrides for one project. Unlike the rest
+// of .gopilot it is meant to be committed.
+var projectPromptDir = filepath.Join(".gopilot", "prompts")
+
+func userPromptDir() string {
+	return filepath.Join(userConfigDir(), "prompts")
+}
+
+// A promptSource is where a prompt resolves to. path is empty for the
+// embedded default.
+type promptSource struct {
+	name  string
+	layer string
+	path  string
+}
+
+// resolvePrompt finds the prompt called name (as in prompts/): the file of
+// its flag if set, else a file of that name in .gopilot/prompts, else one in
+// the user's prompts directory, else the embedded default.
+func resolvePrompt(name, flagFile string) promptSource {
+	if flagFile != "" {
+		return promptSource{name: name, layer: layerFlag, path: flagFile}
+	}
+	for _, layer := range []struct{ name, dir string }{
+		{layerProject, projectPromptDir},
+		{layerUser, userPromptDir()},
+	} {
+		file := filepath.Join(layer.dir, name)
+		_, err := os.Stat(file)
+		if err == nil {
+			return promptSource{name: name, layer: layer.name, path: file}
+		}
+		if !os.IsNotExist(err) {
+			log.Fatalf("Error reading prompt file %s: %v", file, err)
+		}
+	}
+	return promptSource{name: name, layer: layerEmbedded}
+}
+
+// read returns the prompt. A prompt file that can't be read is fatal rather
+// than quietly replaced by the default.
+func (s promptSource) read() string {
+	if s.path == "" {
+		content, err := promptFS.ReadFile("prompts/" + s.name)
+		if err != nil {
+			log.Fatalf("Error reading default prompt file %s: %v", s.name, err)
+		}
+		return string(content)
+	}
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		log.Fatalf("Error reading prompt file %s: %v", s.path, err)
+	}
+	return string(content)
+}
+
+// promptFlag returns the flag that overrides the prompt called name, and the
+// file it is set to.
+func promptFlag(config Config, name string) (string, string) {
+	switch name {
+	case "branch_name.txt":
+		return "branchprompt", config.BranchPrompt
+	case "commit_message.txt":
+		return "commitmsgprompt", config.CommitMsgPrompt
+	case "changes_goparts.txt":
+		if !config.NoGopart {
+			return "changesprompt", config.ChangesPrompt
+		}
+	case "changes_no_goparts.txt":
+		if config.NoGopart {
+			return "changesprompt", config.ChangesPrompt
+		}
+	case "fix_build.txt", "fix_tests.txt":
+		return "fixjsonprompt", config.FixJsonPrompt
+	}
+	return "", ""
+}
+
+func embeddedPromptNames() []string {
+	entries, err := promptFS.ReadDir("prompts")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// listPrompts prints where each prompt comes from, and the files in the
+// prompt directories that don't override anything.
+func listPrompts(config Config) {
+	known := map[string]bool{}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range embeddedPromptNames() {
+		known[name] = true
+		flagName, flagFile := promptFlag(config, name)
+		source := resolvePrompt(name, flagFile)
+		switch source.layer {
+		case layerEmbedded:
+			fmt.Fprintf(w, "%s\t%s\n", name, source.layer)
+		case layerFlag:
+			problem := ""
+			if _, err := os.Stat(source.path); err != nil {
+				problem = ", can't be read"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s (-%s%s)\n", name, source.layer, source.path, flagName, problem)
+		default:
+			fmt.Fprintf(w, "%s\t%s\t%s\n", name, source.layer, source.path)
+		}
+	}
+	w.Flush()
+
+	var unknown []string
+	for _, dir := range []string{userPromptDir(), projectPromptDir} {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: %v", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && !known[entry.Name()] && filepath.Ext(entry.Name()) == ".txt" {
+				unknown = append(unknown, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(unknown)
+	for _, file := range unknown {
+		fmt.Printf("Warning: %s doesn't match any prompt and is not used\n", file)
+	}
+}
+
+type promptUse struct {
+	caller string
+	vars   []string
+}
+
+// promptUses lists, for each prompt rendered as a template, the functions
+// that render it and the values they supply. Keep it in sync with the call
+// sites; the project context of contextFields is there for every prompt.
+var promptUses = map[string][]promptUse{
+	"branch_name.txt":            {{"generateBranchName", []string{"Prompt", "CurrentBranch"}}},
+	"commit_message.txt":         {{"generateCommitMessage", []string{"Prompt", "ProjectName"}}},
+	"fix_build.txt":              {{"fixBuild", []string{"BuildErrors", "ProjectName"}}},
+	"fix_tests.txt":              {{"fixTests", []string{"TestErrors", "ProjectName"}}},
+	"summarize_conversation.txt": {{"compact", []string{"ProjectName", "Branch", "Summary", "Turns"}}},
+	"changes_goparts.txt":        changesPromptUses,
+	"changes_no_goparts.txt":     changesPromptUses,
+}
+
+var changesPromptUses = []promptUse{
+	{"generateChanges", []string{"Prompt", "Files", "ProjectName", "RepoMap", "Structured"}},
+	{"generateAdditionalChanges", []string{"Prompt", "ExistingChanges", "RemainingContent", "ProjectName", "RepoMap", "Structured"}},
+}
+
+// exportPrompts writes the embedded prompts to dir as a starting point for
+// overrides. Files that are already there are left alone.
+func exportPrompts(dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Error creating %s: %v", dir, err)
+	}
+	for _, name := range embeddedPromptNames() {
+		file := filepath.Join(dir, name)
+		if _, err := os.Stat(file); err == nil {
+			fmt.Println("Skipping", file, "(already exists)")
+			continue
+		}
+		content := promptSource{name: name, layer: layerEmbedded}.read()
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			log.Fatalf("Error writing %s: %v", file, err)
+		}
+		fmt.Println("Wrote", file)
+	}
+}
+
+// lintPrompts checks the prompts gopilot renders as templates, from
+// wherever they resolve to, and prints what is wrong with them. It returns
+// the number of errors; fields that only some callers supply are warnings.
+func lintPrompts(config Config) int {
+	failures := 0
+	for _, name := range embeddedPromptNames() {
+		uses, ok := promptUses[name]
+		if !ok {
+			continue
+		}
+		_, flagFile := promptFlag(config, name)
+		source := resolvePrompt(name, flagFile)
+		file := source.path
+		if file == "" {
+			file = "prompts/" + name
+		}
+
+		tmpl, err := parsePromptTemplate(file, source.read())
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			failures++
+			continue
+		}
+
+		problems := 0
+		for _, t := range tmpl.templates() {
+			if t.Tree == nil {
+				continue
+			}
+			walkFields(t.Tree.Root, true, func(field string, node parse.Node) {
+				if _, ok := contextFields[field]; ok {
+					return
+				}
+				var missing []string
+				for _, use := range uses {
+					if !contains(use.vars, field) {
+						missing = append(missing, use.caller)
+					}
+				}
+				if len(missing) == 0 {
+					return
+				}
+				location, _ := t.Tree.ErrorContext(node)
+				problems++
+				if len(missing) < len(uses) {
+					fmt.Printf("warning: %s: .%s is not supplied by %s and renders as <no value> there\n", location, field, strings.Join(missing, ", "))
+					return
+				}
+				failures++
+				fmt.Printf("error: %s: unknown field .%s%s\n", location, field, suggestField(field, uses))
+			})
+		}
+		if problems == 0 {
+			fmt.Printf("ok: %s\n", file)
+		}
+	}
+	return failures
+}
+
+// suggestField names the field the prompt probably meant, if any is close.
+func suggestField(field string, uses []promptUse) string {
+	var candidates []string
+	for _, use := range uses {
+		candidates = append(candidates, use.vars...)
+	}
+	for name := range contextFields {
+		candidates = append(candidates, name)
+	}
+	sort.Strings(candidates)
+
+	best, bestDistance := "", 3
+	for _, candidate := range candidates {
+		if d := editDistance(strings.ToLower(field), strings.ToLower(candidate)); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean .%s?)", best)
+}
+
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// insertSystemMessage adds a system message after those the prompt starts
+// with, but ahead of the cache break, so it is part of the cached prefix.
+func insertSystemMessage(messages []ChatMessage, content string) []ChatMessage {
+	i := 0
+	for i < len(messages) && messages[i].Role == RoleSystem && !messages[i].Cache {
+		i++
+	}
+	result := append([]ChatMessage{}, messages[:i]...)
+	result = append(result, ChatMessage{Role: RoleSystem, Content: content})
+	return append(result, messages[i:]...)
+}
+
+// A promptPart is a section of a prompt template, sent as a message of its
+// role, or a cache break.
+type promptPart struct {
+	role       string
+	tmpl       *template.Template
+	cacheBreak bool
+}
+
+// A promptTemplate is a prompt template split into messages. Section markers
+// on a line of their own start a message of their role; text before the
+// first one is from the user. A cache break ends a message and marks
+// everything up to it for caching. The markers are found in the template
+// before it is executed, so the values put into a prompt, like build output
+// or files of the repository, can't start a message of their own.
+type promptTemplate struct {
+	parts []promptPart
+}
+
+// parsePromptTemplate splits text at its markers and parses each section as
+// a template of its own. A section is padded with the newlines before it, so
+// errors point at the right line of text.
+func parsePromptTemplate(name, text string) (*promptTemplate, error) {
+	p := &promptTemplate{}
+	role := RoleUser
+	var section strings.Builder
+	start := 0
+	flush := func(next int) error {
+		if strings.TrimSpace(section.String()) != "" {
+			tmpl, err := newPromptTemplate(name).Parse(strings.Repeat("\n", start) + section.String())
+			if err != nil {
+				return err
+			}
+			p.parts = append(p.parts, promptPart{role: role, tmpl: tmpl})
+		}
+		section.Reset()
+		start = next
+		return nil
+	}
+
+	for i, line := range strings.SplitAfter(text, "\n") {
+		marker := strings.TrimSpace(line)
+		sectionRole, isSection := sectionRoles[marker]
+		if !isSection && marker != cacheBreak {
+			section.WriteString(line)
+			continue
+		}
+		if err := flush(i + 1); err != nil {
+			return nil, err
+		}
+		if isSection {
+			role = sectionRole
+		} else {
+			p.parts = append(p.parts, promptPart{cacheBreak: true})
+		}
+	}
+	if err := flush(0); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// templates returns the templates of all sections.
+func (p *promptTemplate) templates() []*template.Template {
+	var templates []*template.Template
+	for _, part := range p.parts {
+		if part.tmpl != nil {
+			templates = append(templates, part.tmpl.Templates()...)
+		}
+	}
+	return templates
+}
+
+// fields returns the fields of the data the sections refer to.
+func (p *promptTemplate) fields() map[string]bool {
+	return templateFields(p.templates()...)
+}
+
+// text executes the template with data into plain text, for prompts that go
+// into another prompt rather than into a request of their own: the sections
+// are joined and their roles and the cache break dropped.
+func (p *promptTemplate) text(data any) (string, error) {
+	messages, err := p.messages(data, nil)
+	if err != nil {
+		return "", err
+	}
+	sections := make([]string, len(messages))
+	for i, m := range messages {
+		sections[i] = m.Content
+	}
+	return strings.Join(sections, "\n\n"), nil
+}
+
+// messages executes each section with data into the messages of a request.
+// Sections that render empty are left out. The conversation so far goes
+// after the cache break, or else before the last user message.
+func (p *promptTemplate) messages(data any, history []ChatMessage) ([]ChatMessage, error) {
+	var messages []ChatMessage
+	insertAt := -1
+	for _, part := range p.parts {
+		if part.cacheBreak {
+			if len(messages) > 0 {
+				messages[len(messages)-1].Cache = true
+			}
+			insertAt = len(messages)
+			continue
+		}
+		var content strings.Builder
+		if err := part.tmpl.Execute(&content, data); err != nil {
+			return nil, err
+		}
+		if text := strings.TrimSpace(content.String()); text != "" {
+			messages = append(messages, ChatMessage{Role: part.role, Content: text})
+		}
+	}
+
+	if insertAt < 0 {
+		insertAt = len(messages)
+		for i := len(messages) - 1; i >= 0; i-- {
+			if messages[i].Role == RoleUser {
+				insertAt = i
+				break
+			}
+		}
+	}
+	result := append([]ChatMessage{}, messages[:insertAt]...)
+	result = append(result, history...)
+	return append(result, messages[insertAt:]...), nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleTool      = "tool" // the result of a tool call
+)
+
+// ChatMessage is a message of a conversation. Cache marks the end of a
+// prefix that stays the same between requests, which providers with explicit
+// prompt caching are told to cache.
+type ChatMessage struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`   // made in an assistant message
+	ToolCallID string     `json:"tool_call_id,omitempty"` // the call a RoleTool message answers
+	Cache      bool       `json:"cache,omitempty"`
+}
+
+type ChatRequest struct {
+	Model          string          `json:"model"`
+	Messages       []ChatMessage   `json:"messages"`
+	Temperature    float32         `json:"temperature,omitempty"`
+	MaxTokens      int             `json:"max_tokens,omitempty"` // 0 leaves it to the backend default
+	Tools          []Tool          `json:"tools,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"` // see supportsStructuredOutput
+}
+
+// ResponseFormat is a named JSON schema the reply has to match.
+type ResponseFormat struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+// Tool is a function the model may call instead of answering in text.
+// Parameters is the JSON schema of its arguments.
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// ToolCall is a call the model made, with its arguments as a JSON object. In
+// a stream a call comes in pieces: the first chunk for an Index has the ID
+// and Name, and the Arguments of all chunks for it are concatenated.
+type ToolCall struct {
+	Index     int    `json:"index"`
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// arguments returns the arguments of a call as a JSON object, for backends
+// that take them as one rather than as text. Arguments the model got wrong
+// become an empty object.
+func (c ToolCall) arguments() json.RawMessage {
+	if !json.Valid([]byte(c.Arguments)) || !strings.HasPrefix(strings.TrimSpace(c.Arguments), "{") {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(c.Arguments)
+}
+
+type Usage struct {
+	InputTokens       int     `json:"input_tokens,omitempty"` // including CachedInputTokens
+	OutputTokens      int     `json:"output_tokens,omitempty"`
+	CachedInputTokens int     `json:"cached_input_tokens,omitempty"` // read from the provider's prompt cache
+	CacheWriteTokens  int     `json:"cache_write_tokens,omitempty"`  // written to it, for providers that charge extra
+	Cost              float64 `json:"cost,omitempty"`                // as reported by the backend, 0 when it doesn't
+}
+
+// add adds other to u.
+func (u *Usage) add(other Usage) {
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+	u.CachedInputTokens += other.CachedInputTokens
+	u.CacheWriteTokens += other.CacheWriteTokens
+	u.Cost += other.Cost
+}
+
+type ChatResponse struct {
+	Model        string     `json:"model"`
+	Content      string     `json:"content"`
+	FinishReason string     `json:"finish_reason,omitempty"` // "tool_calls" when the model called tools
+	ToolCalls    []ToolCall `json:"tool_calls,omitempty"`
+	Usage        Usage      `json:"usage"`
+}
+
+type ChatStreamChunk struct {
+	Content      string     `json:"content,omitempty"`
+	ToolCalls    []ToolCall `json:"tool_calls,omitempty"`
+	FinishReason string     `json:"finish_reason,omitempty"`
+	Reset        bool       `json:"reset,omitempty"` // the stream restarted; drop everything received so far
+}
+
+// addToolCalls merges the tool call pieces of a stream chunk into calls.
+func addToolCalls(calls []ToolCall, pieces []ToolCall) []ToolCall {
+	for _, piece := range pieces {
+		i := 0
+		for i < len(calls) && calls[i].Index != piece.Index {
+			i++
+		}
+		if i == len(calls) {
+			calls = append(calls, ToolCall{Index: piece.Index})
+		}
+		if piece.ID != "" {
+			calls[i].ID = piece.ID
+		}
+		if piece.Name != "" {
+			calls[i].Name = piece.Name
+		}
+		calls[i].Arguments += piece.Arguments
+	}
+	return calls
+}
+
+// ChatStream is a streamed completion. Recv returns io.EOF once the stream is
+// done; Usage is only meaningful after that and is zero when the backend did
+// not report any.
+type ChatStream interface {
+	Recv() (ChatStreamChunk, error)
+	Usage() Usage
+	Close() error
+}
+
+// Provider is an LLM backend. Everything that talks to a model goes through
+// this interface, so backends can be swapped (or faked) without touching the
+// call sites.
+type Provider interface {
+	CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error)
+	CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error)
+}
+
+// newProvider builds the backend for the given config. It is a variable so a
+// fake provider can be swapped in.
+var newProvider = func(config Config) Provider {
+	switch config.Provider {
+	case "anthropic":
+		return newAnthropicClient(config)
+	case "local":
+		return newLocalClient(config)
+	default:
+		return newOpenAIClient(config)
+	}
+}
+
+func defaultBaseURL(provider string) string {
+	switch provider {
+	case "anthropic":
+		return "https://api.anthropic.com/v1"
+	case "local":
+		return "http://localhost:11434"
+	default:
+		return "https://openrouter.ai/api/v1/chat/completions"
+	}
+}
+
+// sessionProvider keeps currentSession up to date for whatever backend it
+// wraps. Requests to free (local) backends are counted but cost nothing.
+type sessionProvider struct {
+	Provider
+	free bool
+}
+
+func createProvider(config Config) Provider {
+	var backend Provider
+	if config.Replay != "" {
+		backend = &replayProvider{cassette: replayCassette(config.Replay)}
+	} else {
+		backend = newProvider(config)
+	}
+
+	var provider Provider = &retryProvider{Provider: backend, maxRetries: config.MaxRetries, budget: config.Budget}
+	provider = &structuredProvider{Provider: provider}
+	provider = &sessionProvider{Provider: provider, free: config.Provider == "local"}
+	// a replay must see every request in order, so it bypasses the cache. So
+	// do repairs: when a fix leaves the errors as they were, the same request
+	// would get the same failed fix from the cache, for free and forever.
+	if !config.Cache.Disabled && config.Replay == "" && config.Task != taskBuildRepair && config.Task != taskTestRepair {
+		provider = newCacheProvider(provider, config)
+	}
+	if config.Record != "" {
+		provider = &recordingProvider{Provider: provider, cassette: recordingCassette(config.Record)}
+	}
+	return provider
+}
+
+func countRequest() {
+	sessionMu.Lock()
+	currentSession.Requests++
+	sessionMu.Unlock()
+}
+
+func (s *sessionProvider) record(model string, usage Usage) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	cost := 0.0
+	if !s.free {
+		cost = calculateCost(model, usage)
+	}
+	currentSession.record(usage, cost)
+	if cost > 0 {
+		dailySpend.add(cost)
+	}
+}
+
+func (s *sessionProvider) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	response, err := s.Provider.CreateChatCompletion(ctx, request)
+	if err == nil {
+		countRequest()
+		s.record(response.Model, fillUsage(request, response.Content+toolCallText(response.ToolCalls), response.Usage))
+	}
+	return response, err
+}
+
+func (s *sessionProvider) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	stream, err := s.Provider.CreateChatCompletionStream(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	countRequest()
+	return &sessionStream{ChatStream: stream, session: s, request: request}, nil
+}
+
+// toolCallText is what the model wrote for calls, to count its tokens.
+func toolCallText(calls []ToolCall) string {
+	var text strings.Builder
+	for _, call := range calls {
+		text.WriteString(call.Name)
+		text.WriteString(call.Arguments)
+	}
+	return text.String()
+}
+
+// fillUsage counts the tokens the backend didn't report.
+func fillUsage(request ChatRequest, content string, usage Usage) Usage {
+	if usage.InputTokens == 0 {
+		usage.InputTokens = countMessageTokens(request.Model, request.Messages)
+	}
+	if usage.OutputTokens == 0 {
+		usage.OutputTokens = countTokens(request.Model, content)
+	}
+	return usage
+}
+
+// sessionStream adds the usage of a streamed completion to the session, the
+// same way as for other completions. A stream that fails or is closed early
+// used tokens as well, so the usage is recorded once the stream ends in any
+// way: drained, failed or closed.
+type sessionStream struct {
+	ChatStream
+	session *sessionProvider
+	request ChatRequest
+	content strings.Builder
+	done    bool
+}
+
+func (s *sessionStream) Recv() (ChatStreamChunk, error) {
+	chunk, err := s.ChatStream.Recv()
+	if err != nil {
+		s.finish()
+		return chunk, err
+	}
+	if chunk.Reset {
+		s.content.Reset()
+	}
+	s.content.WriteString(chunk.Content + toolCallText(chunk.ToolCalls))
+	return chunk, nil
+}
+
+func (s *sessionStream) Close() error {
+	s.finish()
+	return s.ChatStream.Close()
+}
+
+// finish records the usage of the stream, the first time it is called.
+func (s *sessionStream) finish() {
+	if s.done {
+		return
+	}
+	s.done = true
+	s.session.record(s.request.Model, fillUsage(s.request, s.content.String(), s.ChatStream.Usage()))
+}
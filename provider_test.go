@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeProvider answers requests with canned responses, in order, and keeps
+// the requests it got.
+type fakeProvider struct {
+	responses []ChatResponse
+	err       error // returned by a stream after its content
+	requests  []ChatRequest
+}
+
+func (f *fakeProvider) next(request ChatRequest) (ChatResponse, error) {
+	f.requests = append(f.requests, request)
+	if len(f.responses) == 0 {
+		return ChatResponse{}, errors.New("fake: no response left")
+	}
+	response := f.responses[0]
+	f.responses = f.responses[1:]
+	if response.Model == "" {
+		response.Model = request.Model
+	}
+	return response, nil
+}
+
+func (f *fakeProvider) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	return f.next(request)
+}
+
+func (f *fakeProvider) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	response, err := f.next(request)
+	if err != nil {
+		return nil, err
+	}
+	// one chunk per word, the finish reason on the last
+	var chunks []ChatStreamChunk
+	for _, word := range strings.SplitAfter(response.Content, " ") {
+		chunks = append(chunks, ChatStreamChunk{Content: word})
+	}
+	chunks[len(chunks)-1].FinishReason = response.FinishReason
+	return &fakeStream{chunks: chunks, usage: response.Usage, err: f.err}, nil
+}
+
+type fakeStream struct {
+	chunks []ChatStreamChunk
+	usage  Usage
+	err    error
+	closed bool
+}
+
+func (s *fakeStream) Recv() (ChatStreamChunk, error) {
+	if len(s.chunks) == 0 {
+		if s.err != nil {
+			return ChatStreamChunk{}, s.err
+		}
+		return ChatStreamChunk{}, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+func (s *fakeStream) Usage() Usage {
+	return s.usage
+}
+
+func (s *fakeStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+// useFakeProvider makes createProvider use a fake backend with responses
+// for the rest of the test, and starts a new session.
+func useFakeProvider(t *testing.T, responses ...ChatResponse) *fakeProvider {
+	fake := &fakeProvider{responses: responses}
+	saved, savedSession := newProvider, currentSession
+	newProvider = func(Config) Provider { return fake }
+	currentSession = Session{}
+	t.Cleanup(func() {
+		newProvider, currentSession = saved, savedSession
+	})
+	return fake
+}
+
+func testConfig() Config {
+	config := Config{OrLow: "fake-low", OrHigh: "fake-high"}
+	config.Cache.Disabled = true
+	return config
+}
+
+func TestGenerateBranchName(t *testing.T) {
+	fake := useFakeProvider(t, ChatResponse{Content: " gopilot/add-retries\n"})
+	config := testConfig()
+	config.Prompt = "Add retries to the client"
+
+	got, err := generateBranchName(context.Background(), config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "gopilot/add-retries" {
+		t.Errorf("generateBranchName() = %q, want %q", got, "gopilot/add-retries")
+	}
+	if len(fake.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(fake.requests))
+	}
+	request := fake.requests[0]
+	if request.Model != config.OrLow {
+		t.Errorf("request went to %s, want the low model %s", request.Model, config.OrLow)
+	}
+	if last := request.Messages[len(request.Messages)-1]; !strings.Contains(last.Content, config.Prompt) {
+		t.Errorf("last message %q does not contain the prompt", last.Content)
+	}
+	if currentSession.Requests != 1 || currentSession.InputTokens == 0 || currentSession.OutputTokens == 0 {
+		t.Errorf("session = %+v, want one request with counted tokens", currentSession)
+	}
+}
+
+func TestGenerateChanges(t *testing.T) {
+	// generateChanges writes split orders next to the changed files
+	wd, _ := os.Getwd()
+	t.Cleanup(func() { os.Chdir(wd) })
+	os.Chdir(t.TempDir())
+
+	fake := useFakeProvider(t, ChatResponse{
+		Content:      `[{"filepath": "editor/main/run.gopart", "content": "func run() {}\n"}]`,
+		FinishReason: "stop",
+	})
+	config := testConfig()
+	config.Prompt = "Add a run function"
+	config.NoRouting = true
+	files := []FileContent{{FilePath: "editor/main/imports.gopart", Content: "package main\n"}}
+
+	changes, err := generateChanges(context.Background(), config, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []FileContent{{FilePath: "editor/main/run.gopart", Content: "func run() {}\n"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("generateChanges() = %+v, want %+v", changes, want)
+	}
+	if len(fake.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(fake.requests))
+	}
+	request := fake.requests[0]
+	if request.Model != config.OrHigh {
+		t.Errorf("request went to %s, want the high model %s", request.Model, config.OrHigh)
+	}
+	var sent strings.Builder
+	for _, m := range request.Messages {
+		sent.WriteString(m.Content)
+	}
+	for _, part := range []string{config.Prompt, "editor/main/imports.gopart"} {
+		if !strings.Contains(sent.String(), part) {
+			t.Errorf("request does not contain %q", part)
+		}
+	}
+}
+
+func TestStreamCompletion(t *testing.T) {
+	fake := useFakeProvider(t, ChatResponse{
+		Content:      "[] is all",
+		FinishReason: "stop",
+		Usage:        Usage{InputTokens: 100, OutputTokens: 3},
+	})
+
+	response, err := streamCompletion(context.Background(), createProvider(testConfig()), ChatRequest{Model: "fake-high"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ChatResponse{Model: "fake-high", Content: "[] is all", FinishReason: "stop"}
+	response.Usage = Usage{}
+	if !reflect.DeepEqual(response, want) {
+		t.Errorf("streamCompletion() = %+v, want %+v", response, want)
+	}
+	if len(fake.requests) != 1 {
+		t.Errorf("got %d requests, want 1", len(fake.requests))
+	}
+	if currentSession.Requests != 1 || currentSession.InputTokens != 100 || currentSession.OutputTokens != 3 {
+		t.Errorf("session = %+v, want the usage of one request", currentSession)
+	}
+}
+
+func TestSessionStreamRecordsOnce(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error // ends the stream
+	}{
+		{"drained", nil},
+		{"failed", errors.New("connection reset")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeProvider(t, ChatResponse{Content: "some words", Usage: Usage{InputTokens: 10, OutputTokens: 2}})
+			fake.err = tt.err
+			session := &sessionProvider{Provider: fake}
+
+			stream, err := session.CreateChatCompletionStream(context.Background(), ChatRequest{Model: "fake"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for err == nil {
+				_, err = stream.Recv()
+			}
+			stream.Recv()
+			stream.Close()
+
+			if currentSession.InputTokens != 10 || currentSession.OutputTokens != 2 {
+				t.Errorf("session = %+v, want the usage recorded once", currentSession)
+			}
+		})
+	}
+}
+
+func TestSessionStreamRecordsOnClose(t *testing.T) {
+	fake := useFakeProvider(t, ChatResponse{Content: "more than one chunk"})
+	session := &sessionProvider{Provider: fake}
+
+	stream, err := session.CreateChatCompletionStream(context.Background(), ChatRequest{
+		Model:    "fake",
+		Messages: []ChatMessage{{Role: RoleUser, Content: "a prompt of some length"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Recv()
+	stream.Close()
+
+	// the backend reported nothing, so the tokens are counted
+	if currentSession.InputTokens == 0 || currentSession.OutputTokens == 0 {
+		t.Errorf("session = %+v, want the usage of the abandoned stream", currentSession)
+	}
+}
+
+func TestAddToolCalls(t *testing.T) {
+	tests := []struct {
+		name   string
+		calls  []ToolCall
+		pieces []ToolCall
+		want   []ToolCall
+	}{
+		{
+			name:   "first piece",
+			pieces: []ToolCall{{Index: 0, ID: "call_1", Name: "write_file", Arguments: `{"file`}},
+			want:   []ToolCall{{Index: 0, ID: "call_1", Name: "write_file", Arguments: `{"file`}},
+		},
+		{
+			name:   "arguments are appended",
+			calls:  []ToolCall{{Index: 0, ID: "call_1", Name: "write_file", Arguments: `{"file`}},
+			pieces: []ToolCall{{Index: 0, Arguments: `path":"a.go"}`}},
+			want:   []ToolCall{{Index: 0, ID: "call_1", Name: "write_file", Arguments: `{"filepath":"a.go"}`}},
+		},
+		{
+			name:   "a new index starts a call",
+			calls:  []ToolCall{{Index: 0, ID: "call_1", Name: "write_file", Arguments: `{}`}},
+			pieces: []ToolCall{{Index: 1, ID: "call_2", Name: "delete_file"}},
+			want: []ToolCall{
+				{Index: 0, ID: "call_1", Name: "write_file", Arguments: `{}`},
+				{Index: 1, ID: "call_2", Name: "delete_file"},
+			},
+		},
+		{
+			name: "pieces of several calls in one chunk",
+			calls: []ToolCall{
+				{Index: 0, ID: "call_1", Name: "write_file", Arguments: `{"a`},
+				{Index: 1, ID: "call_2", Name: "write_file", Arguments: `{"b`},
+			},
+			pieces: []ToolCall{{Index: 1, Arguments: `":2}`}, {Index: 0, Arguments: `":1}`}},
+			want: []ToolCall{
+				{Index: 0, ID: "call_1", Name: "write_file", Arguments: `{"a":1}`},
+				{Index: 1, ID: "call_2", Name: "write_file", Arguments: `{"b":2}`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addToolCalls(tt.calls, tt.pieces); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("addToolCalls() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
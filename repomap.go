@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const defaultRepoMapBodies = 10
+
+// elidedBody stands in for the bodies left out of a .go file sent with only
+// the bodies likely to change; restoreBodies puts them back in the model's
+// version of the file.
+const (
+	elidedBody   = "{\n\t// body left out, unchanged\n}"
+	elidedHeader = "// Only some function bodies are included here. Keep a body that says \"body left out, unchanged\" as it is to leave that function unchanged.\n"
+)
+
+// RepoMapConfig controls the repo map: when Enabled, the changes prompt gets
+// the declarations of all Go files, and only the files of the Bodies most
+// relevant symbols are sent in full.
+type RepoMapConfig struct {
+	Enabled bool
+	Bodies  int
+}
+
+// A mapSymbol is a top-level declaration in the repo map.
+type mapSymbol struct {
+	name        string // for methods, the method name
+	key         string // of functions and methods, see funcKey
+	receiver    string // type of the receiver, "*T" for pointer receivers
+	declaration string // without function bodies and comments
+	source      string
+	score       int
+}
+
+// A mapFile is a Go file or .gopart fragment with its declarations.
+type mapFile struct {
+	file    FileContent
+	pkgDir  string // directory of the package, the same for a .go file and its .gopart files
+	pkg     string // package name, "" for fragments without a package clause
+	symbols []mapSymbol
+	score   int // the best score of its symbols
+}
+
+// packageDir returns the directory of the package path belongs to. The
+// .gopart files of editor/x/y.go/ belong to the package in x.
+func packageDir(path string) string {
+	if filepath.Ext(path) == ".gopart" {
+		return filepath.Dir(strings.TrimPrefix(filepath.Dir(path), "editor"+string(filepath.Separator)))
+	}
+	return filepath.Dir(path)
+}
+
+// funcKey identifies a function in its file: the name, after the receiver
+// type for methods.
+func funcKey(d *ast.FuncDecl) string {
+	if d.Recv == nil || len(d.Recv.List) == 0 {
+		return d.Name.Name
+	}
+	return receiverType(d.Recv.List[0].Type) + "." + d.Name.Name
+}
+
+func isGoFile(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".go" || ext == ".gopart"
+}
+
+// parseMapFile reads the declarations of a Go file or .gopart fragment.
+func parseMapFile(file FileContent) (mapFile, bool) {
+	src := file.Content
+	if !strings.HasPrefix(strings.TrimSpace(src), "package ") {
+		src = "package p\n\n" + src
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file.FilePath, src, parser.SkipObjectResolution)
+	if err != nil {
+		return mapFile{}, false
+	}
+
+	m := mapFile{file: file, pkgDir: packageDir(file.FilePath)}
+	if src == file.Content {
+		m.pkg = f.Name.Name
+	}
+	format := func(node any) string {
+		var buf bytes.Buffer
+		(&printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}).Fprint(&buf, fset, node)
+		return buf.String()
+	}
+	source := func(node ast.Node) string {
+		return src[fset.Position(node.Pos()).Offset:fset.Position(node.End()).Offset]
+	}
+
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			symbol := mapSymbol{name: d.Name.Name, key: funcKey(d), source: source(d)}
+			if d.Recv != nil {
+				symbol.receiver = receiverType(d.Recv.List[0].Type)
+				if _, ok := d.Recv.List[0].Type.(*ast.StarExpr); ok {
+					symbol.receiver = "*" + symbol.receiver
+				}
+			}
+			d.Doc, d.Body = nil, nil
+			symbol.declaration = format(d)
+			m.symbols = append(m.symbols, symbol)
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					s.Doc, s.Comment = nil, nil
+					m.symbols = append(m.symbols, mapSymbol{name: s.Name.Name, declaration: "type " + format(s), source: source(s)})
+				case *ast.ValueSpec:
+					// values can be long; names and type are enough here
+					for _, name := range s.Names {
+						declaration := d.Tok.String() + " " + name.Name
+						if s.Type != nil {
+							declaration += " " + format(s.Type)
+						}
+						m.symbols = append(m.symbols, mapSymbol{name: name.Name, declaration: declaration, source: source(s)})
+					}
+				}
+			}
+		}
+	}
+	return m, true
+}
+
+// scoreSymbols rates the symbols of m like relevance rates files: a symbol
+// named in the prompt scores high, and every prompt word in its source adds
+// a point.
+func (m *mapFile) scoreSymbols(words map[string]bool) {
+	for i := range m.symbols {
+		s := &m.symbols[i]
+		if words[strings.ToLower(s.name)] {
+			s.score += 100
+		}
+		s.score += wordScore(words, s.source)
+		if s.score > m.score {
+			m.score = s.score
+		}
+	}
+}
+
+// repoMapSources reads the Go files of the whole project for the repo map,
+// whichever files are sent with the prompt. A .go file split into .gopart
+// files is read from its fragments in editor/, unless .gopart files are off.
+func repoMapSources(config Config) []FileContent {
+	var sources []FileContent
+	editor := "editor" + string(filepath.Separator)
+	filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path == "editor" && !config.NoGopart {
+				return nil
+			}
+			if skipDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".gopart":
+			if !strings.HasPrefix(path, editor) {
+				return nil
+			}
+		case ".go":
+			if strings.HasPrefix(path, editor) {
+				return nil
+			}
+			if !config.NoGopart {
+				if info, err := os.Stat(filepath.Join("editor", strings.TrimSuffix(path, ".go"))); err == nil && info.IsDir() {
+					return nil
+				}
+			}
+		default:
+			return nil
+		}
+		addFileContent(&sources, path)
+		return nil
+	})
+	return sources
+}
+
+// buildRepoMap lists the declarations of sources, the Go files of the
+// project, the most relevant to the prompt first, and picks the files to
+// send among files: those holding the bodies most likely to change, plus
+// other files named in the prompt and Go files that aren't in the map. A
+// .gopart file holds one function, but a whole .go file is sent with only
+// the bodies likely to change; see restoreBodies. It returns an empty map
+// when nothing matches the prompt.
+func buildRepoMap(files, sources []FileContent, prompt string, bodies int) (string, []FileContent) {
+	words := promptWords(prompt)
+	var mapped []mapFile
+	inFull := map[string]bool{}
+	sent := map[string]bool{}
+	packages := map[string]string{}
+	for _, file := range files {
+		path := filepath.Clean(file.FilePath)
+		sent[path] = true
+		// Go files are in full unless they are mapped below
+		inFull[path] = isGoFile(path) || relevance(prompt, words, file) >= 100
+	}
+	for _, file := range sources {
+		m, ok := parseMapFile(file)
+		if !ok {
+			continue
+		}
+		m.scoreSymbols(words)
+		if m.pkg != "" {
+			packages[m.pkgDir] = m.pkg
+		}
+		mapped = append(mapped, m)
+		delete(inFull, filepath.Clean(file.FilePath))
+	}
+
+	sort.SliceStable(mapped, func(i, j int) bool { return mapped[i].score > mapped[j].score })
+	if len(mapped) == 0 || mapped[0].score == 0 {
+		return "", files
+	}
+
+	// the files with the best scoring symbols are sent
+	type ranked struct {
+		file   int
+		symbol mapSymbol
+	}
+	var symbols []ranked
+	for i, m := range mapped {
+		if !sent[filepath.Clean(m.file.FilePath)] {
+			continue
+		}
+		for _, s := range m.symbols {
+			if s.score > 0 {
+				symbols = append(symbols, ranked{i, s})
+			}
+		}
+	}
+	sort.SliceStable(symbols, func(i, j int) bool { return symbols[i].symbol.score > symbols[j].symbol.score })
+	keep := map[string][]string{} // the bodies to send, by .go file
+	for i := 0; i < len(symbols) && i < bodies; i++ {
+		path := filepath.Clean(mapped[symbols[i].file].file.FilePath)
+		inFull[path] = true
+		if key := symbols[i].symbol.key; key != "" && filepath.Ext(path) == ".go" {
+			keep[path] = append(keep[path], key)
+		}
+	}
+	// a .go file goes with only the bodies of its selected functions
+	elided := map[string]FileContent{}
+	for _, file := range files {
+		path := filepath.Clean(file.FilePath)
+		if inFull[path] && filepath.Ext(path) == ".go" {
+			if e := elideBodies(file, keep[path]); e.Content != file.Content {
+				elided[path] = e
+			}
+		}
+	}
+	for path, full := range inFull {
+		// imports often change along with the code
+		if imports := filepath.Join(filepath.Dir(path), "imports.gopart"); full && filepath.Ext(path) == ".gopart" && sent[imports] {
+			inFull[imports] = true
+		}
+	}
+
+	var repoMap strings.Builder
+	methods := map[string][]string{}
+	for _, m := range mapped {
+		if len(m.symbols) == 0 {
+			continue
+		}
+		pkg := packages[m.pkgDir]
+		fmt.Fprintf(&repoMap, "%s (package %s)", m.file.FilePath, pkg)
+		path := filepath.Clean(m.file.FilePath)
+		switch _, ok := elided[path]; {
+		case ok && len(keep[path]) > 0:
+			fmt.Fprintf(&repoMap, ", below with the bodies of %s only", strings.Join(keep[path], ", "))
+		case ok:
+			repoMap.WriteString(", below without function bodies")
+		case inFull[path]:
+			repoMap.WriteString(", in full below")
+		}
+		repoMap.WriteString(":\n")
+		for _, s := range m.symbols {
+			fmt.Fprintf(&repoMap, "  %s\n", strings.ReplaceAll(s.declaration, "\n", "\n  "))
+			if s.receiver != "" {
+				key := pkg + "." + s.receiver
+				methods[key] = append(methods[key], s.name)
+			}
+		}
+	}
+	if len(methods) > 0 {
+		var types []string
+		for t := range methods {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		repoMap.WriteString("Method sets:\n")
+		for _, t := range types {
+			fmt.Fprintf(&repoMap, "  %s: %s\n", t, strings.Join(methods[t], ", "))
+		}
+	}
+
+	var full []FileContent
+	var left []string
+	for _, file := range files {
+		path := filepath.Clean(file.FilePath)
+		switch e, ok := elided[path]; {
+		case ok:
+			full = append(full, e)
+		case inFull[path]:
+			full = append(full, file)
+		case !isGoFile(path):
+			left = append(left, file.FilePath)
+		}
+	}
+	if len(left) > 0 {
+		fmt.Println("Left out, as the prompt doesn't name them:", strings.Join(left, ", "))
+	}
+	return repoMap.String(), full
+}
+
+// elideBodies returns file with the bodies of the functions other than keep,
+// by funcKey, replaced by elidedBody.
+func elideBodies(file FileContent, keep []string) FileContent {
+	kept := map[string]bool{}
+	for _, key := range keep {
+		kept[key] = true
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file.FilePath, file.Content, parser.SkipObjectResolution)
+	if err != nil {
+		return file
+	}
+
+	var content strings.Builder
+	last := 0
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.FuncDecl)
+		if !ok || d.Body == nil || kept[funcKey(d)] {
+			continue
+		}
+		content.WriteString(file.Content[last:fset.Position(d.Body.Lbrace).Offset])
+		content.WriteString(elidedBody)
+		last = fset.Position(d.Body.Rbrace).Offset + 1
+	}
+	if last == 0 {
+		return file
+	}
+	content.WriteString(file.Content[last:])
+	return FileContent{FilePath: file.FilePath, Content: elidedHeader + content.String()}
+}
+
+// restoreBodies puts the bodies elideBodies left out back into the changes
+// to those files, taken from the project files as they were sent.
+func restoreBodies(changes, files []FileContent) []FileContent {
+	originals := map[string]string{}
+	for _, file := range files {
+		originals[filepath.Clean(file.FilePath)] = file.Content
+	}
+	for i, change := range changes {
+		if change.Delete || !strings.Contains(change.Content, "body left out, unchanged") {
+			continue
+		}
+		original, ok := originals[filepath.Clean(change.FilePath)]
+		if !ok {
+			log.Printf("Warning: %s has bodies left out, but there is no file to take them from", change.FilePath)
+			continue
+		}
+		content, err := spliceBodies(change.FilePath, strings.TrimPrefix(change.Content, elidedHeader), original)
+		if err != nil {
+			log.Printf("Warning: bodies left out of %s can't be put back: %v", change.FilePath, err)
+			continue
+		}
+		changes[i].Content = content
+	}
+	return changes
+}
+
+// spliceBodies replaces each body of content that is elidedBody with the
+// body of the same function in original.
+func spliceBodies(path, content, original string) (string, error) {
+	bodies := map[string]string{}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, original, parser.SkipObjectResolution)
+	if err != nil {
+		return "", err
+	}
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok && d.Body != nil {
+			bodies[funcKey(d)] = original[fset.Position(d.Body.Lbrace).Offset : fset.Position(d.Body.Rbrace).Offset+1]
+		}
+	}
+
+	fset = token.NewFileSet()
+	f, err = parser.ParseFile(fset, path, content, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return "", err
+	}
+	elided := strings.Join(strings.Fields(elidedBody), " ")
+	var result strings.Builder
+	last := 0
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.FuncDecl)
+		if !ok || d.Body == nil {
+			continue
+		}
+		start, end := fset.Position(d.Body.Lbrace).Offset, fset.Position(d.Body.Rbrace).Offset+1
+		if strings.Join(strings.Fields(content[start:end]), " ") != elided {
+			continue
+		}
+		body, ok := bodies[funcKey(d)]
+		if !ok {
+			return "", fmt.Errorf("%s has no body in the original", funcKey(d))
+		}
+		result.WriteString(content[last:start])
+		result.WriteString(body)
+		last = end
+	}
+	result.WriteString(content[last:])
+	return result.String(), nil
+}
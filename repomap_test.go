@@ -0,0 +1,170 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBuildRepoMapSelection(t *testing.T) {
+	gopart := func(name, content string) FileContent {
+		return FileContent{FilePath: filepath.Join("editor", "main.go", name+".gopart"), Content: content}
+	}
+	files := []FileContent{
+		gopart("imports", "package main\n\nimport \"fmt\"\n"),
+		gopart("retryRequest", "func retryRequest() error {\n\treturn sendRequest()\n}\n"),
+		gopart("sendRequest", "func sendRequest() error {\n\treturn nil\n}\n"),
+		gopart("parseFlags", "func parseFlags() {\n\tfmt.Println(\"flags\")\n}\n"),
+		{FilePath: "README.md", Content: "# Demo\n"},
+		{FilePath: "NOTES.md", Content: "retry notes\n"},
+	}
+	tests := []struct {
+		name   string
+		prompt string
+		bodies int
+		want   []string
+	}{
+		{
+			name:   "named function and its imports",
+			prompt: "Make retryRequest back off exponentially",
+			bodies: 1,
+			want:   []string{"editor/main.go/imports.gopart", "editor/main.go/retryRequest.gopart"},
+		},
+		{
+			name:   "bodies limit",
+			prompt: "Make retryRequest call sendRequest twice",
+			bodies: 2,
+			want:   []string{"editor/main.go/imports.gopart", "editor/main.go/retryRequest.gopart", "editor/main.go/sendRequest.gopart"},
+		},
+		{
+			name:   "only one body of two",
+			prompt: "Make retryRequest call sendRequest twice",
+			bodies: 1,
+			want:   []string{"editor/main.go/imports.gopart", "editor/main.go/retryRequest.gopart"},
+		},
+		{
+			name:   "named non-Go file",
+			prompt: "Describe parseFlags in README.md",
+			bodies: 1,
+			want:   []string{"README.md", "editor/main.go/imports.gopart", "editor/main.go/parseFlags.gopart"},
+		},
+		{
+			name:   "nothing matches",
+			prompt: "Translate everything into Latin",
+			bodies: 1,
+			want:   nil, // no map, all files
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoMap, full := buildRepoMap(files, files, tt.prompt, tt.bodies)
+			if tt.want == nil {
+				if repoMap != "" || len(full) != len(files) {
+					t.Errorf("got a map and %d files, want no map and all files", len(full))
+				}
+				return
+			}
+			var got []string
+			for _, file := range full {
+				got = append(got, filepath.ToSlash(file.FilePath))
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("files sent = %v, want %v", got, tt.want)
+			}
+			if !strings.Contains(repoMap, "func parseFlags()") {
+				t.Errorf("map does not list parseFlags:\n%s", repoMap)
+			}
+		})
+	}
+}
+
+const repoMapGoFile = `package main
+
+import "fmt"
+
+type Client struct{ retries int }
+
+func (c *Client) Retry() error {
+	return c.Send()
+}
+
+func (c *Client) Send() error {
+	fmt.Println("sending")
+	return nil
+}
+
+func main() {
+	fmt.Println("main")
+}
+`
+
+func TestBuildRepoMapGoFileBodies(t *testing.T) {
+	files := []FileContent{{FilePath: "main.go", Content: repoMapGoFile}}
+
+	repoMap, full := buildRepoMap(files, files, "Make Client.Retry try three times", 1)
+
+	if len(full) != 1 {
+		t.Fatalf("sent %d files, want main.go", len(full))
+	}
+	sent := full[0].Content
+	if !strings.Contains(sent, "return c.Send()") {
+		t.Errorf("the body of Retry is left out:\n%s", sent)
+	}
+	for _, body := range []string{`fmt.Println("sending")`, `fmt.Println("main")`} {
+		if strings.Contains(sent, body) {
+			t.Errorf("sent %s, want only the body of Retry:\n%s", body, sent)
+		}
+	}
+	if !strings.Contains(repoMap, "main.go (package main), below with the bodies of Client.Retry only") {
+		t.Errorf("map does not say which bodies are sent:\n%s", repoMap)
+	}
+
+	// the model changes Retry and keeps the markers of the rest
+	changed := strings.Replace(sent, "return c.Send()", "for i := 0; i < 3; i++ {\n\t\tif c.Send() == nil {\n\t\t\treturn nil\n\t\t}\n\t}\n\treturn c.Send()", 1)
+	changes := restoreBodies([]FileContent{{FilePath: "main.go", Content: changed}}, files)
+
+	want := strings.Replace(repoMapGoFile, "return c.Send()", "for i := 0; i < 3; i++ {\n\t\tif c.Send() == nil {\n\t\t\treturn nil\n\t\t}\n\t}\n\treturn c.Send()", 1)
+	if changes[0].Content != want {
+		t.Errorf("restored file =\n%s\nwant\n%s", changes[0].Content, want)
+	}
+}
+
+func TestSpliceBodies(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		err     bool
+	}{
+		{
+			name:    "reindented marker",
+			content: "package main\n\nfunc main() {\n  // body left out, unchanged\n}\n",
+			want:    "package main\n\nfunc main() {\n\tfmt.Println(\"main\")\n}\n",
+		},
+		{
+			name:    "new function is kept",
+			content: "package main\n\nfunc main() " + elidedBody + "\n\nfunc added() {}\n",
+			want:    "package main\n\nfunc main() {\n\tfmt.Println(\"main\")\n}\n\nfunc added() {}\n",
+		},
+		{
+			name:    "marker in a function that wasn't there",
+			content: "package main\n\nfunc other() " + elidedBody + "\n",
+			err:     true,
+		},
+	}
+	original := "package main\n\nfunc main() {\n\tfmt.Println(\"main\")\n}\n"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := spliceBodies("main.go", tt.content, original)
+			if (err != nil) != tt.err {
+				t.Fatalf("spliceBodies() error = %v, want an error: %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("spliceBodies() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 5
+	retryBaseDelay    = time.Second
+	retryMaxDelay     = time.Minute
+)
+
+// ProviderError is an HTTP level error returned by a backend. RetryAfter is
+// set when the server told us how long to wait.
+type ProviderError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *ProviderError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// parseRetryAfter understands both forms of the Retry-After header: a number
+// of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
+
+// retryAfterTransport remembers the Retry-After header of the last failed
+// response, for clients that don't expose response headers on errors.
+type retryAfterTransport struct {
+	base http.RoundTripper
+	mu   sync.Mutex
+	last time.Duration
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode >= 400 {
+		t.mu.Lock()
+		t.last = parseRetryAfter(resp.Header.Get("Retry-After"))
+		t.mu.Unlock()
+	}
+	return resp, err
+}
+
+func (t *retryAfterTransport) retryAfter() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.last
+}
+
+// isRetryable reports whether err is worth another attempt: rate limits,
+// server side errors and dropped connections.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		switch providerErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+			return true
+		}
+		return providerErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// retryDelay is an exponential backoff with jitter, unless the server asked
+// for a specific delay.
+func retryDelay(attempt int, err error) time.Duration {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) && providerErr.RetryAfter > 0 {
+		return providerErr.RetryAfter
+	}
+
+	delay := retryBaseDelay << attempt
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// prefiller is implemented by backends that continue a trailing assistant
+// message instead of starting a new reply, which lets us resume streams.
+type prefiller interface {
+	SupportsPrefill() bool
+}
+
+// retryProvider retries failed requests with backoff and resumes interrupted
+// streams. Every attempt is checked against the budget, as a retry costs as
+// much as the first one.
+type retryProvider struct {
+	Provider
+	maxRetries int
+	budget     Budget
+}
+
+func (r *retryProvider) retry(ctx context.Context, what string, call func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err := checkBudget(r.budget); err != nil {
+			return err
+		}
+		err = call()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+		if attempt >= r.maxRetries {
+			return fmt.Errorf("%s: giving up after %d attempts: %w", what, attempt+1, err)
+		}
+
+		delay := retryDelay(attempt, err)
+		log.Printf("Warning: %s failed (%v), retrying in %s (attempt %d of %d)", what, err, delay.Round(time.Millisecond), attempt+2, r.maxRetries+1)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *retryProvider) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	var response ChatResponse
+	err := r.retry(ctx, "chat completion", func() error {
+		var err error
+		response, err = r.Provider.CreateChatCompletion(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (r *retryProvider) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	stream, err := r.openStream(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return &retryStream{provider: r, ctx: ctx, request: request, stream: stream}, nil
+}
+
+func (r *retryProvider) openStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	var stream ChatStream
+	err := r.retry(ctx, "chat completion stream", func() error {
+		var err error
+		stream, err = r.Provider.CreateChatCompletionStream(ctx, request)
+		return err
+	})
+	return stream, err
+}
+
+func (r *retryProvider) canResume() bool {
+	p, ok := r.Provider.(prefiller)
+	return ok && p.SupportsPrefill()
+}
+
+// retryStream reopens the stream when it breaks off. Backends that support
+// prefill continue from what was already received; for the others, and once
+// tool calls came in, the request starts over and a Reset chunk tells the
+// reader to drop its partial result.
+type retryStream struct {
+	provider  *retryProvider
+	ctx       context.Context
+	request   ChatRequest
+	stream    ChatStream
+	received  []byte
+	toolCalls bool
+	usage     Usage
+	failures  int
+}
+
+func (s *retryStream) Recv() (ChatStreamChunk, error) {
+	chunk, err := s.stream.Recv()
+	if err == nil {
+		s.received = append(s.received, chunk.Content...)
+		s.toolCalls = s.toolCalls || len(chunk.ToolCalls) > 0
+		return chunk, nil
+	}
+	if errors.Is(err, io.EOF) {
+		return chunk, err
+	}
+	if !isRetryable(err) {
+		return chunk, err
+	}
+	if s.failures >= s.provider.maxRetries {
+		return chunk, fmt.Errorf("chat completion stream: giving up after %d interruptions: %w", s.failures+1, err)
+	}
+
+	delay := retryDelay(s.failures, err)
+	s.failures++
+	log.Printf("Warning: stream interrupted (%v) after %d bytes, reconnecting in %s", err, len(s.received), delay.Round(time.Millisecond))
+	if err := sleepContext(s.ctx, delay); err != nil {
+		return ChatStreamChunk{}, err
+	}
+
+	s.usage.add(s.stream.Usage())
+	s.stream.Close()
+
+	request := s.request
+	reset := s.toolCalls || (len(s.received) > 0 && !s.provider.canResume())
+	if len(s.received) > 0 && !reset {
+		request.Messages = append(append([]ChatMessage{}, s.request.Messages...), ChatMessage{Role: RoleAssistant, Content: string(s.received)})
+	}
+
+	s.stream, err = s.provider.openStream(s.ctx, request)
+	if err != nil {
+		return ChatStreamChunk{}, err
+	}
+	if reset {
+		s.received = nil
+		s.toolCalls = false
+		return ChatStreamChunk{Reset: true}, nil
+	}
+	return s.Recv()
+}
+
+// Usage adds up the usage of the streams that broke off and the current one.
+func (s *retryStream) Usage() Usage {
+	usage := s.usage
+	usage.add(s.stream.Usage())
+	return usage
+}
+
+func (s *retryStream) Close() error {
+	return s.stream.Close()
+}
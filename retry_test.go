@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		min, max time.Duration
+	}{
+		{name: "empty", value: ""},
+		{name: "seconds", value: "7", min: 7 * time.Second, max: 7 * time.Second},
+		{name: "zero seconds", value: "0"},
+		{name: "HTTP date", value: time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat), min: 28 * time.Second, max: 30 * time.Second},
+		{name: "HTTP date in the past", value: "Mon, 02 Jan 2006 15:04:05 GMT", min: -1 << 63, max: 0},
+		{name: "garbage", value: "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "12")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	transport := &retryAfterTransport{base: http.DefaultTransport}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := transport.retryAfter(); got != 12*time.Second {
+		t.Errorf("retryAfter() = %s, want 12s", got)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &ProviderError{StatusCode: http.StatusTooManyRequests, Err: errors.New("slow down")}, want: true},
+		{err: &ProviderError{StatusCode: http.StatusRequestTimeout, Err: errors.New("timeout")}, want: true},
+		{err: &ProviderError{StatusCode: http.StatusConflict, Err: errors.New("conflict")}, want: true},
+		{err: &ProviderError{StatusCode: http.StatusBadGateway, Err: errors.New("bad gateway")}, want: true},
+		{err: &ProviderError{StatusCode: http.StatusBadRequest, Err: errors.New("bad request")}},
+		{err: &ProviderError{StatusCode: http.StatusUnauthorized, Err: errors.New("unauthorized")}},
+		{err: fmt.Errorf("reading: %w", io.ErrUnexpectedEOF), want: true},
+		{err: syscall.ECONNRESET, want: true},
+		{err: syscall.EPIPE, want: true},
+		{err: context.Canceled},
+		{err: context.DeadlineExceeded},
+		{err: errors.New("invalid model")},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempt  int
+		err      error
+		min, max time.Duration
+	}{
+		{name: "first attempt", attempt: 0, err: io.ErrUnexpectedEOF, min: retryBaseDelay / 2, max: retryBaseDelay},
+		{name: "third attempt", attempt: 2, err: io.ErrUnexpectedEOF, min: 2 * retryBaseDelay, max: 4 * retryBaseDelay},
+		{name: "capped", attempt: 20, err: io.ErrUnexpectedEOF, min: retryMaxDelay / 2, max: retryMaxDelay},
+		{name: "overflowing shift", attempt: 80, err: io.ErrUnexpectedEOF, min: retryMaxDelay / 2, max: retryMaxDelay},
+		{
+			name:    "Retry-After wins",
+			attempt: 3,
+			err:     &ProviderError{StatusCode: http.StatusTooManyRequests, RetryAfter: 90 * time.Second, Err: errors.New("slow down")},
+			min:     90 * time.Second,
+			max:     90 * time.Second,
+		},
+		{
+			name:    "backoff without Retry-After",
+			attempt: 1,
+			err:     &ProviderError{StatusCode: http.StatusServiceUnavailable, Err: errors.New("overloaded")},
+			min:     retryBaseDelay,
+			max:     2 * retryBaseDelay,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				if got := retryDelay(tt.attempt, tt.err); got < tt.min || got > tt.max {
+					t.Fatalf("retryDelay(%d) = %s, want between %s and %s", tt.attempt, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+// flakyProvider fails with errs, in order, before answering.
+type flakyProvider struct {
+	errs     []error
+	attempts int
+}
+
+func (p *flakyProvider) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	p.attempts++
+	if len(p.errs) > 0 {
+		err := p.errs[0]
+		p.errs = p.errs[1:]
+		return ChatResponse{}, err
+	}
+	return ChatResponse{Content: "ok"}, nil
+}
+
+func (p *flakyProvider) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	return nil, errors.New("not used")
+}
+
+func TestRetryProvider(t *testing.T) {
+	useSpending(t, 0, 0)
+	overloaded := &ProviderError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Millisecond, Err: errors.New("overloaded")}
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "first try", wantAttempts: 1},
+		{name: "after retries", errs: []error{overloaded, overloaded}, wantAttempts: 3},
+		{name: "not retryable", errs: []error{&ProviderError{StatusCode: http.StatusBadRequest, Err: errors.New("bad request")}}, wantAttempts: 1, wantErr: true},
+		{name: "giving up", errs: []error{overloaded, overloaded, overloaded, overloaded}, wantAttempts: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &flakyProvider{errs: tt.errs}
+			client := &retryProvider{Provider: backend, maxRetries: 2}
+
+			response, err := client.CreateChatCompletion(context.Background(), ChatRequest{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateChatCompletion() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && response.Content != "ok" {
+				t.Errorf("CreateChatCompletion() = %+v, want the answer", response)
+			}
+			if backend.attempts != tt.wantAttempts {
+				t.Errorf("made %d attempts, want %d", backend.attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryProviderStopsOnCancel(t *testing.T) {
+	useSpending(t, 0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	backend := &flakyProvider{errs: []error{&ProviderError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour, Err: errors.New("slow down")}}}
+	client := &retryProvider{Provider: backend, maxRetries: 2}
+
+	if _, err := client.CreateChatCompletion(ctx, ChatRequest{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("CreateChatCompletion() error = %v, want context.Canceled", err)
+	}
+	if backend.attempts != 1 {
+		t.Errorf("made %d attempts, want 1", backend.attempts)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// The kinds of task the router tells apart.
+const (
+	taskBuildRepair = "build-repair" // only set by fixBuild, it has no keywords
+	taskTestRepair  = "test-repair"
+	taskDocEdit     = "doc-edit"
+	taskSmallFix    = "small-fix"
+	taskNewFeature  = "new-feature"
+)
+
+// taskOrder breaks ties between task kinds with as many keyword matches.
+var taskOrder = []string{taskBuildRepair, taskTestRepair, taskDocEdit, taskSmallFix, taskNewFeature}
+
+//go:embed routing.json
+var defaultRouting []byte
+
+// A RouteRule picks the model for the requests it matches. Conditions left
+// at their zero value match everything; the first matching rule wins.
+type RouteRule struct {
+	Task            string `json:"task,omitempty"`
+	MinPromptTokens int    `json:"min_prompt_tokens,omitempty"`
+	MaxPromptTokens int    `json:"max_prompt_tokens,omitempty"`
+	MinFiles        int    `json:"min_files,omitempty"`
+	MaxFiles        int    `json:"max_files,omitempty"`
+	Tier            string `json:"tier,omitempty"`  // "low" or "high"
+	Model           string `json:"model,omitempty"` // a model to use instead of a tier
+	Reason          string `json:"reason,omitempty"`
+}
+
+// Routing tells the kind of task from keywords in the prompt and picks a
+// model for it by the rules.
+type Routing struct {
+	Tasks map[string][]string `json:"tasks"`
+	Rules []RouteRule         `json:"rules"`
+}
+
+var routing = mustParseRouting(defaultRouting)
+
+func mustParseRouting(content []byte) Routing {
+	r, err := parseRouting(content)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func parseRouting(content []byte) (Routing, error) {
+	var r Routing
+	if err := json.Unmarshal(content, &r); err != nil {
+		return r, err
+	}
+	for i, rule := range r.Rules {
+		if rule.Task != "" && !isTask(rule.Task) {
+			return r, fmt.Errorf("rule %d: unknown task %q, use one of %s", i+1, rule.Task, strings.Join(taskOrder, ", "))
+		}
+		if rule.Model == "" && rule.Tier != roleLow && rule.Tier != roleHigh {
+			return r, fmt.Errorf("rule %d: needs a model or a tier of low or high", i+1)
+		}
+	}
+	for task := range r.Tasks {
+		if !isTask(task) {
+			return r, fmt.Errorf("unknown task %q, use one of %s", task, strings.Join(taskOrder, ", "))
+		}
+	}
+	return r, nil
+}
+
+func isTask(task string) bool {
+	for _, t := range taskOrder {
+		if t == task {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRouting reads a user routing file. Its rules replace the built-in ones,
+// and so do the keywords of the tasks it lists.
+func loadRouting(filename string) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	r, err := parseRouting(content)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	if r.Rules != nil {
+		routing.Rules = r.Rules
+	}
+	for task, keywords := range r.Tasks {
+		routing.Tasks[task] = keywords
+	}
+	return nil
+}
+
+// classifyTask returns the kind of task prompt asks for: the one with the
+// most keywords in it, or a new feature when none match.
+func (r Routing) classifyTask(prompt string) (string, []string) {
+	prompt = strings.ToLower(prompt)
+	best, bestMatches := taskNewFeature, []string(nil)
+	for _, task := range taskOrder {
+		var matches []string
+		for _, keyword := range r.Tasks[task] {
+			pattern := `(^|\W)` + regexp.QuoteMeta(strings.ToLower(keyword)) + `($|\W)`
+			if regexp.MustCompile(pattern).MatchString(prompt) {
+				matches = append(matches, keyword)
+			}
+		}
+		if len(matches) > len(bestMatches) {
+			best, bestMatches = task, matches
+		}
+	}
+	return best, bestMatches
+}
+
+func (rule RouteRule) matches(task string, promptTokens, files int) bool {
+	return (rule.Task == "" || rule.Task == task) &&
+		promptTokens >= rule.MinPromptTokens &&
+		(rule.MaxPromptTokens == 0 || promptTokens <= rule.MaxPromptTokens) &&
+		files >= rule.MinFiles &&
+		(rule.MaxFiles == 0 || files <= rule.MaxFiles)
+}
+
+// routeModels picks the models to generate changes with, followed by their
+// fallbacks, and says why. fixBuild and fixTests set config.Task; for a user
+// prompt the kind of task is told from its keywords.
+func routeModels(config Config, fileCount int) ([]string, string) {
+	if config.NoRouting {
+		return modelChain(config, roleHigh), "routing is off"
+	}
+
+	task, why := config.Task, "a failing make target"
+	if task == "" {
+		var keywords []string
+		task, keywords = routing.classifyTask(config.Prompt)
+		why = "no keywords"
+		if len(keywords) > 0 {
+			why = "keywords: " + strings.Join(keywords, ", ")
+		}
+	}
+	promptTokens := countTokens(config.OrHigh, config.Prompt)
+	reason := fmt.Sprintf("%s task (%s), %d prompt tokens, %d files", task, why, promptTokens, fileCount)
+
+	for i, rule := range routing.Rules {
+		if !rule.matches(task, promptTokens, fileCount) {
+			continue
+		}
+		reason += fmt.Sprintf("; rule %d", i+1)
+		if rule.Reason != "" {
+			reason += ": " + rule.Reason
+		}
+		if rule.Model != "" {
+			return append([]string{rule.Model}, modelChain(config, roleHigh)...), reason
+		}
+		return modelChain(config, rule.Tier), reason
+	}
+	return modelChain(config, roleHigh), reason + "; no rule matched"
+}
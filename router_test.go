@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClassifyTask(t *testing.T) {
+	tests := []struct {
+		prompt   string
+		task     string
+		keywords []string
+	}{
+		{"Fix the typo in the README", taskDocEdit, []string{"readme", "typo"}},
+		{"Fix the crash when the config is empty", taskSmallFix, []string{"fix", "crash"}},
+		{"Add support for YAML configs", taskNewFeature, []string{"add", "support"}},
+		{"The tests fail since yesterday, make the tests pass", taskTestRepair, []string{"tests fail", "make the tests pass"}},
+		{"Speed up startup", taskNewFeature, nil},
+		// keywords match whole words only
+		{"Prefix every log line", taskNewFeature, nil},
+	}
+	for _, tt := range tests {
+		task, keywords := routing.classifyTask(tt.prompt)
+		if task != tt.task || !reflect.DeepEqual(keywords, tt.keywords) {
+			t.Errorf("classifyTask(%q) = %s %v, want %s %v", tt.prompt, task, keywords, tt.task, tt.keywords)
+		}
+	}
+}
+
+func TestParseRouting(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"built in", string(defaultRouting), false},
+		{"unknown task in a rule", `{"rules":[{"task":"refactor","tier":"low"}]}`, true},
+		{"unknown task with keywords", `{"tasks":{"refactor":["refactor"]}}`, true},
+		{"rule without tier or model", `{"rules":[{"task":"doc-edit"}]}`, true},
+		{"rule with a model", `{"rules":[{"min_files":200,"model":"google/gemini-2.5-pro"}]}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseRouting([]byte(tt.content)); (err != nil) != tt.wantErr {
+				t.Errorf("parseRouting() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSSEReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []sseEvent
+	}{
+		{"empty", "", nil},
+		{"data only", "data: {\"a\":1}\n\ndata: [DONE]\n\n", []sseEvent{{Data: `{"a":1}`}, {Data: "[DONE]"}}},
+		{"named events", "event: message_start\ndata: {}\n\nevent: ping\ndata: {}\n\n", []sseEvent{{Event: "message_start", Data: "{}"}, {Event: "ping", Data: "{}"}}},
+		{"data over several lines", "data: first\ndata: second\n\n", []sseEvent{{Data: "first\nsecond"}}},
+		{"comments and extra blank lines", ": keep-alive\n\n\ndata: x\n: more\n\n", []sseEvent{{Data: "x"}}},
+		{"no space after the colon", "data:x\n\n", []sseEvent{{Data: "x"}}},
+		{"CRLF line ends", "event: e\r\ndata: x\r\n\r\n", []sseEvent{{Event: "e", Data: "x"}}},
+		{"no blank line at the end", "data: last", []sseEvent{{Data: "last"}}},
+		{"unknown fields", "id: 7\nretry: 100\ndata: x\n\n", []sseEvent{{Data: "x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := newSSEReader(strings.NewReader(tt.stream))
+			var got []sseEvent
+			for {
+				event, err := reader.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, event)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
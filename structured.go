@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// changesFormat asks for the changes as {"changes": [...]}: response schemas
+// must have an object at the root.
+var changesFormat = &ResponseFormat{
+	Name:   "file_changes",
+	Schema: mustMarshal(objectSchema(map[string]any{"changes": arraySchema(reflect.TypeOf(FileContent{}))})),
+}
+
+type structuredChanges struct {
+	Changes []FileContent `json:"changes"`
+}
+
+func mustMarshal(v any) json.RawMessage {
+	content, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return content
+}
+
+// supportsStructuredOutput reports whether the backend may take a JSON schema
+// for the reply. The Anthropic Messages API has no response_format. Models
+// behind OpenRouter that don't support it ignore it, which extractChanges
+// copes with; backends that reject it are handled by structuredProvider.
+func supportsStructuredOutput(config Config) bool {
+	return !config.NoStructuredOutput && config.Provider != "anthropic"
+}
+
+// structuredProvider resends a request without its response format when the
+// backend rejects it, as older Ollama and llama.cpp servers and some
+// OpenAI compatible ones do, and leaves the format out for that model from
+// then on. The prompt still describes the format, which extractChanges reads
+// as well as a bare list.
+type structuredProvider struct {
+	Provider
+	mu       sync.Mutex
+	rejected map[string]bool // models whose backend rejected a response format
+}
+
+// withoutFormat returns request without its response format if the model is
+// known to reject it.
+func (s *structuredProvider) withoutFormat(request ChatRequest) ChatRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rejected[request.Model] {
+		request.ResponseFormat = nil
+	}
+	return request
+}
+
+// rejects reports whether err is the backend turning down the response
+// format of request, and remembers it for the model.
+func (s *structuredProvider) rejects(request ChatRequest, err error) bool {
+	var providerErr *ProviderError
+	if request.ResponseFormat == nil || !errors.As(err, &providerErr) || providerErr.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	log.Printf("Warning: %s rejected the response format (%v), sending the request again without it", request.Model, err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rejected == nil {
+		s.rejected = map[string]bool{}
+	}
+	s.rejected[request.Model] = true
+	return true
+}
+
+func (s *structuredProvider) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	request = s.withoutFormat(request)
+	response, err := s.Provider.CreateChatCompletion(ctx, request)
+	if s.rejects(request, err) {
+		request.ResponseFormat = nil
+		return s.Provider.CreateChatCompletion(ctx, request)
+	}
+	return response, err
+}
+
+func (s *structuredProvider) CreateChatCompletionStream(ctx context.Context, request ChatRequest) (ChatStream, error) {
+	request = s.withoutFormat(request)
+	stream, err := s.Provider.CreateChatCompletionStream(ctx, request)
+	if s.rejects(request, err) {
+		request.ResponseFormat = nil
+		return s.Provider.CreateChatCompletionStream(ctx, request)
+	}
+	return stream, err
+}
+
+// jsonSchema describes t the way strict structured output wants it: every
+// property is required and fields with omitempty may be null instead.
+func jsonSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return arraySchema(t.Elem())
+	case reflect.Struct:
+		properties := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			schema := jsonSchema(field.Type)
+			if strings.Contains(options, "omitempty") {
+				schema["type"] = []any{schema["type"], "null"}
+			}
+			properties[name] = schema
+		}
+		return objectSchema(properties)
+	}
+	panic("jsonSchema: unsupported type " + t.String())
+}
+
+func arraySchema(elem reflect.Type) map[string]any {
+	return map[string]any{"type": "array", "items": jsonSchema(elem)}
+}
+
+func objectSchema(properties map[string]any) map[string]any {
+	required := make([]string, 0, len(properties))
+	for name := range properties {
+		required = append(required, name)
+	}
+	// keep the schema, and so the cache key, the same between runs
+	sort.Strings(required)
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// parseStructuredChanges reads a reply in changesFormat.
+func parseStructuredChanges(rawChanges string) ([]FileContent, bool) {
+	var structured structuredChanges
+	decoder := json.NewDecoder(strings.NewReader(rawChanges))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&structured); err != nil || structured.Changes == nil {
+		return nil, false
+	}
+	return structured.Changes, true
+}
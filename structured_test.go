@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONSchema(t *testing.T) {
+	type inner struct {
+		Name string `json:"name"`
+	}
+	type outer struct {
+		Path     string  `json:"path"`
+		Lines    int     `json:"lines,omitempty"`
+		Ratio    float64 `json:"ratio"`
+		Done     bool
+		Items    []inner `json:"items"`
+		Skipped  string  `json:"-"`
+		internal string
+	}
+
+	tests := []struct {
+		name string
+		t    reflect.Type
+		want map[string]any
+	}{
+		{"string", reflect.TypeOf(""), map[string]any{"type": "string"}},
+		{"int", reflect.TypeOf(0), map[string]any{"type": "integer"}},
+		{"slice", reflect.TypeOf([]bool{}), map[string]any{"type": "array", "items": map[string]any{"type": "boolean"}}},
+		{
+			name: "struct",
+			t:    reflect.TypeOf(outer{}),
+			want: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"path":  map[string]any{"type": "string"},
+					"lines": map[string]any{"type": []any{"integer", "null"}},
+					"ratio": map[string]any{"type": "number"},
+					"Done":  map[string]any{"type": "boolean"},
+					"items": map[string]any{"type": "array", "items": map[string]any{
+						"type":                 "object",
+						"properties":           map[string]any{"name": map[string]any{"type": "string"}},
+						"required":             []string{"name"},
+						"additionalProperties": false,
+					}},
+				},
+				"required":             []string{"Done", "items", "lines", "path", "ratio"},
+				"additionalProperties": false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jsonSchema(tt.t); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("jsonSchema() =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStructuredChanges(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  []FileContent
+		ok    bool
+	}{
+		{"changes", `{"changes":[{"filepath":"a.go","content":"package a"}]}`, []FileContent{{FilePath: "a.go", Content: "package a"}}, true},
+		{"no changes", `{"changes":[]}`, []FileContent{}, true},
+		{"bare array", `[{"filepath":"a.go","content":"package a"}]`, nil, false},
+		{"unknown field", `{"changes":[],"note":"done"}`, nil, false},
+		{"missing changes", `{}`, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseStructuredChanges(tt.reply)
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseStructuredChanges() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// rejectingProvider fails requests with a response format the way a backend
+// without structured output does.
+type rejectingProvider struct {
+	fakeProvider
+}
+
+func (r *rejectingProvider) CreateChatCompletion(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	if request.ResponseFormat != nil {
+		r.requests = append(r.requests, request)
+		return ChatResponse{}, &ProviderError{StatusCode: http.StatusBadRequest, Err: fmt.Errorf("response_format is not supported")}
+	}
+	return r.next(request)
+}
+
+func TestStructuredProviderResendsWithoutFormat(t *testing.T) {
+	backend := &rejectingProvider{fakeProvider{responses: []ChatResponse{{Content: "[]"}, {Content: "[]"}}}}
+	provider := &structuredProvider{Provider: backend}
+	request := ChatRequest{Model: "local-model", ResponseFormat: changesFormat}
+
+	for i := 0; i < 2; i++ {
+		if _, err := provider.CreateChatCompletion(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first request is sent twice, the second only without the format
+	var formats []bool
+	for _, r := range backend.requests {
+		formats = append(formats, r.ResponseFormat != nil)
+	}
+	if want := []bool{true, false, false}; !reflect.DeepEqual(formats, want) {
+		t.Errorf("requests with a format = %v, want %v", formats, want)
+	}
+}
+
+func TestStructuredProviderKeepsOtherErrors(t *testing.T) {
+	backend := &rejectingProvider{}
+	provider := &structuredProvider{Provider: backend}
+
+	// without a format a bad request is not about the format
+	if _, err := provider.CreateChatCompletion(context.Background(), ChatRequest{Model: "m"}); err == nil {
+		t.Error("got no error, want the one of the backend")
+	}
+	if provider.rejected["m"] {
+		t.Error("the model is marked as rejecting the format")
+	}
+}
+
+// TestChangesPromptsMatchFormat checks that the example in the changes
+// prompts has the shape the reply is parsed in.
+func TestChangesPromptsMatchFormat(t *testing.T) {
+	for _, name := range []string{"changes_goparts.txt", "changes_no_goparts.txt"} {
+		for _, structured := range []string{"", "true"} {
+			t.Run(fmt.Sprintf("%s structured=%q", name, structured), func(t *testing.T) {
+				content, err := promptFS.ReadFile("prompts/" + name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tmpl, err := parsePromptTemplate(name, string(content))
+				if err != nil {
+					t.Fatal(err)
+				}
+				messages, err := tmpl.messages(map[string]any{"Structured": structured}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, example, _ := strings.Cut(messages[0].Content, "Example output:\n\n")
+				example, _, _ = strings.Cut(example, "\n\nNote")
+
+				if structured != "" {
+					if _, ok := parseStructuredChanges(example); !ok {
+						t.Errorf("example is not in the structured format:\n%s", example)
+					}
+				} else if err := json.Unmarshal([]byte(example), &[]FileContent{}); err != nil {
+					t.Errorf("example is not a list of changes (%v):\n%s", err, example)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"golang.org/x/mod/modfile"
+)
+
+// gitLogCount is how many commits {{.GitLog}} shows.
+const gitLogCount = 20
+
+// promptFuncs are the functions prompt templates can use besides the
+// text/template builtins.
+var promptFuncs = template.FuncMap{
+	"join":      func(sep string, items []string) string { return strings.Join(items, sep) },
+	"split":     func(sep, s string) []string { return strings.Split(s, sep) },
+	"lines":     func(s string) []string { return strings.Split(strings.TrimRight(s, "\n"), "\n") },
+	"trim":      strings.TrimSpace,
+	"upper":     strings.ToUpper,
+	"lower":     strings.ToLower,
+	"contains":  func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix": func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix": func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"replace":   func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"default": func(def, s string) string {
+		if strings.TrimSpace(s) == "" {
+			return def
+		}
+		return s
+	},
+	"indent": func(n int, s string) string {
+		pad := strings.Repeat(" ", n)
+		return pad + strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\n"+pad)
+	},
+	"head": func(n int, s string) string {
+		lines := strings.SplitAfter(s, "\n")
+		if len(lines) <= n {
+			return s
+		}
+		return strings.Join(lines[:n], "")
+	},
+	"truncate": func(n int, s string) string {
+		if len(s) <= n {
+			return s
+		}
+		return s[:n] + "..."
+	},
+	"json": func(v any) (string, error) {
+		content, err := json.MarshalIndent(v, "", "  ")
+		return string(content), err
+	},
+	"opinion": opinion,
+}
+
+func newPromptTemplate(name string) *template.Template {
+	return template.New(name).Funcs(promptFuncs)
+}
+
+// contextFields is the project context prompt templates can use, by field
+// name. Each is only computed when the template refers to it.
+var contextFields = map[string]func(ctx context.Context) any{
+	"FileTree": func(ctx context.Context) any { return fileTree(ctx) },
+	"GitLog": func(ctx context.Context) any {
+		return gitOutput(ctx, "log", "--oneline", "-n", fmt.Sprint(gitLogCount))
+	},
+	"Diff":            func(ctx context.Context) any { return gitOutput(ctx, "diff", "HEAD") },
+	"ModulePath":      func(context.Context) any { return readGoMod().Module.Mod.Path },
+	"GoVersion":       func(context.Context) any { return goModVersion(readGoMod()) },
+	"Packages":        func(context.Context) any { return findPackages() },
+	"ExportedSymbols": func(context.Context) any { return findPackages().exports() },
+	"Conventions":     func(context.Context) any { return readConventions() },
+}
+
+// promptData is what a prompt template is executed with: the values of the
+// call site plus whatever project context the template refers to, given as
+// the fields it uses.
+func promptData(ctx context.Context, fields map[string]bool, vars map[string]string) map[string]any {
+	data := map[string]any{}
+	for field := range fields {
+		if compute, ok := contextFields[field]; ok {
+			data[field] = compute(ctx)
+		}
+	}
+	for name, value := range vars {
+		data[name] = value
+	}
+	return data
+}
+
+// templateFields returns the fields of the data templates refer to, like
+// Prompt for {{.Prompt}} or {{$.Prompt}}. Fields of the dot inside range and
+// with are not fields of the data and are left out.
+func templateFields(templates ...*template.Template) map[string]bool {
+	fields := map[string]bool{}
+	for _, t := range templates {
+		if t.Tree != nil {
+			walkFields(t.Tree.Root, true, func(field string, _ parse.Node) { fields[field] = true })
+		}
+	}
+	return fields
+}
+
+// walkFields calls visit for each field of the data under node.
+func walkFields(node parse.Node, root bool, visit func(field string, node parse.Node)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walkFields(child, root, visit)
+		}
+	case *parse.ActionNode:
+		walkFields(n.Pipe, root, visit)
+	case *parse.TemplateNode:
+		walkFields(n.Pipe, root, visit)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			walkFields(cmd, root, visit)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkFields(arg, root, visit)
+		}
+	case *parse.ChainNode:
+		walkFields(n.Node, root, visit)
+	case *parse.FieldNode:
+		if root {
+			visit(n.Ident[0], n)
+		}
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			visit(n.Ident[1], n)
+		}
+	case *parse.IfNode:
+		walkFields(n.Pipe, root, visit)
+		walkFields(n.List, root, visit)
+		walkFields(n.ElseList, root, visit)
+	case *parse.RangeNode:
+		walkFields(n.Pipe, root, visit)
+		walkFields(n.List, false, visit)
+		walkFields(n.ElseList, root, visit)
+	case *parse.WithNode:
+		walkFields(n.Pipe, root, visit)
+		walkFields(n.List, false, visit)
+		walkFields(n.ElseList, root, visit)
+	}
+}
+
+func gitOutput(ctx context.Context, args ...string) string {
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		exitIfInterrupted(ctx)
+		log.Printf("Warning: git %s for the prompt: %v", strings.Join(args, " "), err)
+	}
+	return strings.TrimRight(string(out), "\n")
+}
+
+// fileTree lists the files git knows about, ignored ones left out, as an
+// indented tree.
+func fileTree(ctx context.Context) string {
+	files := strings.Split(gitOutput(ctx, "ls-files", "--cached", "--others", "--exclude-standard"), "\n")
+	sort.Strings(files)
+
+	var tree strings.Builder
+	var previous []string
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		parts := strings.Split(file, "/")
+		common := 0
+		for common < len(parts)-1 && common < len(previous)-1 && parts[common] == previous[common] {
+			common++
+		}
+		for i := common; i < len(parts); i++ {
+			name := parts[i]
+			if i < len(parts)-1 {
+				name += "/"
+			}
+			fmt.Fprintf(&tree, "%s%s\n", strings.Repeat("  ", i), name)
+		}
+		previous = parts
+	}
+	return tree.String()
+}
+
+func readGoMod() *modfile.File {
+	content, err := os.ReadFile("go.mod")
+	if err == nil {
+		var modFile *modfile.File
+		if modFile, err = modfile.Parse("go.mod", content, nil); err == nil {
+			if modFile.Module == nil {
+				modFile.Module = &modfile.Module{}
+			}
+			return modFile
+		}
+	}
+	log.Printf("Warning: reading go.mod for the prompt: %v", err)
+	return &modfile.File{Module: &modfile.Module{}}
+}
+
+func goModVersion(modFile *modfile.File) string {
+	if modFile.Go == nil {
+		return ""
+	}
+	return modFile.Go.Version
+}
+
+// PackageInfo describes a package of the project for prompt templates.
+type PackageInfo struct {
+	Name       string
+	ImportPath string
+	Dir        string
+	Exported   []string // types, functions, methods (as Type.Method), vars and consts
+}
+
+type packageList []PackageInfo
+
+// String lists the packages one per line, so {{.Packages}} reads well.
+func (l packageList) String() string {
+	var s strings.Builder
+	for _, p := range l {
+		fmt.Fprintf(&s, "%s (package %s, %s)\n", p.ImportPath, p.Name, p.Dir)
+	}
+	return s.String()
+}
+
+// exports lists the exported symbols of each package, one package per line.
+func (l packageList) exports() string {
+	var s strings.Builder
+	for _, p := range l {
+		if len(p.Exported) > 0 {
+			fmt.Fprintf(&s, "%s: %s\n", p.ImportPath, strings.Join(p.Exported, ", "))
+		}
+	}
+	return s.String()
+}
+
+// skipDir reports whether a directory holds no project packages: hidden
+// ones, vendor, testdata and gopilot's editor directory.
+func skipDir(name string) bool {
+	return name != "." && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") ||
+		name == "vendor" || name == "testdata" || name == "editor")
+}
+
+// findPackages parses the Go files of the project, tests left out.
+func findPackages() packageList {
+	modulePath := readGoMod().Module.Mod.Path
+	byDir := map[string]*PackageInfo{}
+	fset := token.NewFileSet()
+
+	filepath.WalkDir(".", func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if skipDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(file) != ".go" || strings.HasSuffix(file, "_test.go") {
+			return nil
+		}
+		f, err := parser.ParseFile(fset, file, nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil
+		}
+
+		dir := filepath.Dir(file)
+		p := byDir[dir]
+		if p == nil {
+			p = &PackageInfo{Name: f.Name.Name, ImportPath: path.Join(modulePath, filepath.ToSlash(dir)), Dir: dir}
+			byDir[dir] = p
+		}
+		p.Exported = append(p.Exported, exportedSymbols(f)...)
+		return nil
+	})
+
+	var packages packageList
+	for _, p := range byDir {
+		sort.Strings(p.Exported)
+		packages = append(packages, *p)
+	}
+	sort.Slice(packages, func(i, j int) bool { return packages[i].ImportPath < packages[j].ImportPath })
+	return packages
+}
+
+func exportedSymbols(f *ast.File) []string {
+	var symbols []string
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if !d.Name.IsExported() {
+				continue
+			}
+			if d.Recv == nil {
+				symbols = append(symbols, d.Name.Name)
+			} else if recv := receiverType(d.Recv.List[0].Type); ast.IsExported(recv) {
+				symbols = append(symbols, recv+"."+d.Name.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if s.Name.IsExported() {
+						symbols = append(symbols, s.Name.Name)
+					}
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						if name.IsExported() {
+							symbols = append(symbols, name.Name)
+						}
+					}
+				}
+			}
+		}
+	}
+	return symbols
+}
+
+// receiverType returns the name of the type of a method receiver, without
+// pointer or type parameters.
+func receiverType(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverType(t.X)
+	case *ast.IndexExpr:
+		return receiverType(t.X)
+	case *ast.IndexListExpr:
+		return receiverType(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPromptFuncs(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		data     map[string]any
+		want     string
+	}{
+		{name: "join", template: `{{join ", " .Items}}`, data: map[string]any{"Items": []string{"a", "b"}}, want: "a, b"},
+		{name: "split", template: `{{range split "," .S}}[{{.}}]{{end}}`, data: map[string]any{"S": "a,b"}, want: "[a][b]"},
+		{name: "lines", template: `{{range lines .S}}<{{.}}>{{end}}`, data: map[string]any{"S": "a\nb\n"}, want: "<a><b>"},
+		{name: "trim upper lower", template: `{{trim .S | upper}} {{lower .S}}`, data: map[string]any{"S": " Go "}, want: "GO  go "},
+		{name: "contains", template: `{{if contains "err" .S}}yes{{end}}`, data: map[string]any{"S": "an error"}, want: "yes"},
+		{name: "prefix and suffix", template: `{{hasPrefix "ma" .S}} {{hasSuffix ".go" .S}}`, data: map[string]any{"S": "main.go"}, want: "true true"},
+		{name: "replace", template: `{{replace "-" "_" .S}}`, data: map[string]any{"S": "a-b-c"}, want: "a_b_c"},
+		{name: "default for empty", template: `{{default "none" .S}}`, data: map[string]any{"S": "  "}, want: "none"},
+		{name: "default for a value", template: `{{default "none" .S}}`, data: map[string]any{"S": "x"}, want: "x"},
+		{name: "indent", template: `{{indent 2 .S}}`, data: map[string]any{"S": "a\nb\n"}, want: "  a\n  b"},
+		{name: "head", template: `{{head 2 .S}}`, data: map[string]any{"S": "1\n2\n3\n"}, want: "1\n2\n"},
+		{name: "head of short text", template: `{{head 5 .S}}`, data: map[string]any{"S": "1\n2"}, want: "1\n2"},
+		{name: "truncate", template: `{{truncate 3 .S}}`, data: map[string]any{"S": "abcdef"}, want: "abc..."},
+		{name: "truncate short text", template: `{{truncate 10 .S}}`, data: map[string]any{"S": "abc"}, want: "abc"},
+		{name: "json", template: `{{json .V}}`, data: map[string]any{"V": map[string]int{"a": 1}}, want: "{\n  \"a\": 1\n}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := newPromptTemplate(tt.name).Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out strings.Builder
+			if err := tmpl.Execute(&out, tt.data); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("%s = %q, want %q", tt.template, out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateFields(t *testing.T) {
+	tests := []struct {
+		template string
+		want     []string
+	}{
+		{template: `{{.Prompt}}`, want: []string{"Prompt"}},
+		{template: `{{.Prompt.Text}}`, want: []string{"Prompt"}},
+		{template: `{{if .Diff}}{{.Diff}}{{else}}{{.FileTree}}{{end}}`, want: []string{"Diff", "FileTree"}},
+		{template: `{{range .Packages}}{{.Name}} {{$.ModulePath}}{{end}}`, want: []string{"ModulePath", "Packages"}},
+		{template: `{{with .GitLog}}{{.}}{{.Ignored}}{{else}}{{.Prompt}}{{end}}`, want: []string{"GitLog", "Prompt"}},
+		{template: `{{define "x"}}{{.Inner}}{{end}}{{template "x" .Outer}}`, want: []string{"Inner", "Outer"}},
+		{template: `{{join ", " (split "," .Files)}}`, want: []string{"Files"}},
+		{template: `plain text`},
+	}
+	for _, tt := range tests {
+		tmpl, err := newPromptTemplate("fields").Parse(tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := templateFields(tmpl.Templates()...)
+		want := map[string]bool{}
+		for _, field := range tt.want {
+			want[field] = true
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("templateFields(%s) = %v, want %v", tt.template, got, want)
+		}
+	}
+}
+
+func TestPromptData(t *testing.T) {
+	testRepo(t)
+	writeFile(t, "go.mod", "module example.com/app\n\ngo 1.21\n")
+	writeFile(t, "app/app.go", "package app\n\ntype Server struct{}\n\nfunc (s *Server) Run() {}\n\nfunc helper() {}\n\nconst Version = \"1\"\n")
+	writeFile(t, "app/app_test.go", "package app\n\nfunc TestIgnored() {}\n")
+	writeFile(t, "editor/main/main.gopart", "func Hidden() {}\n")
+
+	data := promptData(context.Background(), map[string]bool{"ModulePath": true, "GoVersion": true, "ExportedSymbols": true, "Prompt": true}, map[string]string{"Prompt": "Add a server"})
+
+	want := map[string]any{
+		"ModulePath":      "example.com/app",
+		"GoVersion":       "1.21",
+		"ExportedSymbols": "example.com/app/app: Server, Server.Run, Version\n",
+		"Prompt":          "Add a server",
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("promptData() = %#v, want %#v", data, want)
+	}
+}
+
+func TestFileTree(t *testing.T) {
+	testRepo(t)
+	writeFile(t, ".gitignore", "build/\n")
+	writeFile(t, "build/app", "binary")
+	writeFile(t, "cmd/app/main.go", "package main\n")
+	writeFile(t, "cmd/tool/main.go", "package main\n")
+
+	want := ".gitignore\ncmd/\n  app/\n    main.go\n  tool/\n    main.go\nmain.go\n"
+	if got := fileTree(context.Background()); got != want {
+		t.Errorf("fileTree() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Token counting for backends that don't report usage. The BPE ranks are
+// embedded, so this works offline.
+
+var (
+	encodings   = map[string]*tiktoken.Tiktoken{}
+	encodingsMu sync.Mutex
+	loaderOnce  sync.Once
+)
+
+// encodingForModel picks o200k for the newer OpenAI models and cl100k for
+// everything else. For non-OpenAI models it is an approximation.
+func encodingForModel(model string) string {
+	name := model
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	for _, prefix := range []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4", "chatgpt-4o"} {
+		if strings.HasPrefix(name, prefix) {
+			return tiktoken.MODEL_O200K_BASE
+		}
+	}
+	return tiktoken.MODEL_CL100K_BASE
+}
+
+func getEncoding(model string) *tiktoken.Tiktoken {
+	loaderOnce.Do(func() {
+		tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+	})
+
+	name := encodingForModel(model)
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	if enc, ok := encodings[name]; ok {
+		return enc
+	}
+	enc, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		log.Printf("Warning: could not load tokenizer %s: %v", name, err)
+		return nil
+	}
+	encodings[name] = enc
+	return enc
+}
+
+func countTokens(model, text string) int {
+	enc := getEncoding(model)
+	if enc == nil {
+		// roughly four characters per token for English and code
+		return (len(text) + 3) / 4
+	}
+	return len(enc.Encode(text, nil, nil))
+}
+
+// countMessageTokens counts the prompt tokens of a chat request, including
+// the few tokens of framing every message gets.
+func countMessageTokens(model string, messages []ChatMessage) int {
+	tokens := 3 // every reply is primed with <|start|>assistant<|message|>
+	for _, m := range messages {
+		tokens += 3 + countTokens(model, m.Role) + countTokens(model, m.Content) + countTokens(model, toolCallText(m.ToolCalls))
+	}
+	return tokens
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	toolWriteFile  = "write_file"
+	toolDeleteFile = "delete_file"
+	toolInsertFile = "insert_file"
+
+	// maxToolTurns bounds how often the model is answered in tool mode, for
+	// models that never stop calling tools
+	maxToolTurns = 50
+)
+
+// The tool parameters use the JSON names of FileContent, so the arguments of
+// a call decode straight into a change.
+var (
+	writeFileSchema = json.RawMessage(`{
+  "type": "object",
+  "properties": {
+    "filepath": {"type": "string", "description": "Path of the file, relative to the project root"},
+    "content": {"type": "string", "description": "The complete new content of the file"}
+  },
+  "required": ["filepath", "content"],
+  "additionalProperties": false
+}`)
+
+	deleteFileSchema = json.RawMessage(`{
+  "type": "object",
+  "properties": {
+    "filepath": {"type": "string", "description": "Path of the file, relative to the project root"}
+  },
+  "required": ["filepath"],
+  "additionalProperties": false
+}`)
+
+	insertFileSchema = json.RawMessage(`{
+  "type": "object",
+  "properties": {
+    "filepath": {"type": "string", "description": "Path of the new .gopart file"},
+    "content": {"type": "string", "description": "The complete content of the .gopart file"},
+    "insert-before": {"type": "string", "description": "Name of the .gopart (without extension) to put it before"},
+    "insert-after": {"type": "string", "description": "Name of the .gopart (without extension) to put it after"}
+  },
+  "required": ["filepath", "content"],
+  "additionalProperties": false
+}`)
+)
+
+// fileTools are the changes the model can make in tool mode. Inserting only
+// makes sense for .gopart files.
+func fileTools(config Config) []Tool {
+	tools := []Tool{
+		{Name: toolWriteFile, Description: "Create a file or replace its content", Parameters: writeFileSchema},
+		{Name: toolDeleteFile, Description: "Delete a file", Parameters: deleteFileSchema},
+	}
+	if !config.NoGopart {
+		tools = append(tools, Tool{
+			Name:        toolInsertFile,
+			Description: "Create a .gopart file and place it before or after an existing one in the Go file",
+			Parameters:  insertFileSchema,
+		})
+	}
+	return tools
+}
+
+// changeFromToolCall validates a tool call and turns it into a change.
+func changeFromToolCall(call ToolCall) (FileContent, error) {
+	var change FileContent
+	decoder := json.NewDecoder(strings.NewReader(call.Arguments))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&change); err != nil {
+		return change, fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	if change.FilePath == "" {
+		return change, errors.New("filepath is missing")
+	}
+	if filepath.IsAbs(change.FilePath) || strings.HasPrefix(filepath.Clean(change.FilePath), "..") {
+		return change, fmt.Errorf("%s is outside the project", change.FilePath)
+	}
+	if change.Delete {
+		return change, errors.New("unexpected delete argument")
+	}
+
+	switch call.Name {
+	case toolWriteFile:
+		if change.InsertBefore != "" || change.InsertAfter != "" {
+			return change, fmt.Errorf("use %s to place a new .gopart file", toolInsertFile)
+		}
+	case toolDeleteFile:
+		if change.Content != "" || change.InsertBefore != "" || change.InsertAfter != "" {
+			return change, errors.New("only takes a filepath")
+		}
+		change.Delete = true
+	case toolInsertFile:
+		if filepath.Ext(change.FilePath) != ".gopart" {
+			return change, fmt.Errorf("%s is not a .gopart file", change.FilePath)
+		}
+		if (change.InsertBefore == "") == (change.InsertAfter == "") {
+			return change, errors.New("needs exactly one of insert-before and insert-after")
+		}
+	default:
+		return change, errors.New("unknown tool")
+	}
+	return change, nil
+}
+
+// toolCallChecker checks tool calls against the project in dir as the
+// earlier calls leave it, so the model learns what each call will do before
+// the changes are applied.
+type toolCallChecker struct {
+	dir   string
+	files map[string]bool // written (true) or deleted (false) by earlier calls
+}
+
+func newToolCallChecker(dir string) *toolCallChecker {
+	return &toolCallChecker{dir: dir, files: map[string]bool{}}
+}
+
+func (c *toolCallChecker) exists(path string) bool {
+	if exists, ok := c.files[path]; ok {
+		return exists
+	}
+	_, err := os.Stat(filepath.Join(c.dir, path))
+	return err == nil
+}
+
+// check validates call and returns the change it makes and what that does
+// to the project.
+func (c *toolCallChecker) check(call ToolCall) (FileContent, string, error) {
+	change, err := changeFromToolCall(call)
+	if err != nil {
+		return change, "", err
+	}
+
+	path := filepath.Clean(change.FilePath)
+	var outcome string
+	switch {
+	case change.Delete:
+		if !c.exists(path) {
+			return change, "", fmt.Errorf("%s does not exist", change.FilePath)
+		}
+		outcome = change.FilePath + " will be deleted"
+	case change.InsertBefore != "" || change.InsertAfter != "":
+		if c.exists(path) {
+			return change, "", fmt.Errorf("%s already exists, use %s to replace it", change.FilePath, toolWriteFile)
+		}
+		insertBefore, insertionPoint := getInsertionPoint(change)
+		anchor := filepath.Join(filepath.Dir(path), insertionPoint+".gopart")
+		if !c.exists(anchor) {
+			return change, "", fmt.Errorf("%s does not exist", anchor)
+		}
+		where := "after"
+		if insertBefore {
+			where = "before"
+		}
+		outcome = fmt.Sprintf("%s will be created %s %s", change.FilePath, where, insertionPoint)
+	case c.exists(path):
+		outcome = change.FilePath + " will be replaced"
+	default:
+		outcome = change.FilePath + " will be created"
+	}
+	c.files[path] = !change.Delete
+	return change, outcome, nil
+}
+
+// changesFromToolCalls validates the tool calls of a response against the
+// project in dir and returns the changes they make. Invalid calls are
+// skipped with a warning. Like extractChanges, it leaves the split order to
+// processLocations.
+func changesFromToolCalls(dir string, calls []ToolCall) []FileContent {
+	checker := newToolCallChecker(dir)
+	var changes []FileContent
+	for _, call := range calls {
+		change, _, err := checker.check(call)
+		if err != nil {
+			log.Printf("Warning: skipping %s call: %v", call.Name, err)
+			continue
+		}
+		fmt.Printf("Tool call: %s %s\n", call.Name, change.FilePath)
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// completeWithTools sends request with send and, as long as the model stops
+// to call tools, answers each call and sends the conversation again: models
+// often make one call per turn. A call is answered with what it will do to
+// the project in dir, or why it can't, so the model can correct it. The
+// changes are applied once the model is done. The response returned is the
+// last one, with the tool calls of all turns. Without tool calls it is a
+// single request.
+func completeWithTools(dir string, request ChatRequest, send func(ChatRequest) (ChatResponse, error)) (ChatResponse, error) {
+	checker := newToolCallChecker(dir)
+	var calls []ToolCall
+	for turn := 1; ; turn++ {
+		response, err := send(request)
+		for i := range response.ToolCalls {
+			if response.ToolCalls[i].ID == "" {
+				response.ToolCalls[i].ID = fmt.Sprintf("call_%d_%d", turn, i)
+			}
+		}
+		calls = append(calls, response.ToolCalls...)
+		if err != nil || response.FinishReason != "tool_calls" || len(response.ToolCalls) == 0 {
+			response.ToolCalls = calls
+			return response, err
+		}
+		if turn == maxToolTurns {
+			log.Printf("Warning: the model still calls tools after %d turns, stopping", turn)
+			response.ToolCalls = calls
+			return response, nil
+		}
+
+		messages := append([]ChatMessage{}, request.Messages...)
+		messages = append(messages, ChatMessage{Role: RoleAssistant, Content: response.Content, ToolCalls: response.ToolCalls})
+		for _, call := range response.ToolCalls {
+			_, result, err := checker.check(call)
+			if err != nil {
+				result = "error: " + err.Error()
+			}
+			messages = append(messages, ChatMessage{Role: RoleTool, Content: result, ToolCallID: call.ID})
+		}
+		request.Messages = messages
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChangeFromToolCall(t *testing.T) {
+	tests := []struct {
+		name    string
+		call    ToolCall
+		want    FileContent
+		wantErr bool
+	}{
+		{
+			name: "write",
+			call: ToolCall{Name: toolWriteFile, Arguments: `{"filepath": "main.go", "content": "package main\n"}`},
+			want: FileContent{FilePath: "main.go", Content: "package main\n"},
+		},
+		{
+			name: "delete",
+			call: ToolCall{Name: toolDeleteFile, Arguments: `{"filepath": "old.go"}`},
+			want: FileContent{FilePath: "old.go", Delete: true},
+		},
+		{
+			name: "insert",
+			call: ToolCall{Name: toolInsertFile, Arguments: `{"filepath": "editor/main/run.gopart", "content": "func run() {}\n", "insert-after": "main"}`},
+			want: FileContent{FilePath: "editor/main/run.gopart", Content: "func run() {}\n", InsertAfter: "main"},
+		},
+		{name: "invalid JSON", call: ToolCall{Name: toolWriteFile, Arguments: `{"filepath": `}, wantErr: true},
+		{name: "unknown argument", call: ToolCall{Name: toolWriteFile, Arguments: `{"filepath": "a.go", "content": "", "mode": "0644"}`}, wantErr: true},
+		{name: "missing filepath", call: ToolCall{Name: toolWriteFile, Arguments: `{"content": "x"}`}, wantErr: true},
+		{name: "absolute path", call: ToolCall{Name: toolWriteFile, Arguments: `{"filepath": "/etc/passwd", "content": "x"}`}, wantErr: true},
+		{name: "outside the project", call: ToolCall{Name: toolWriteFile, Arguments: `{"filepath": "../a.go", "content": "x"}`}, wantErr: true},
+		{name: "delete argument", call: ToolCall{Name: toolWriteFile, Arguments: `{"filepath": "a.go", "content": "x", "delete": true}`}, wantErr: true},
+		{name: "write with insertion point", call: ToolCall{Name: toolWriteFile, Arguments: `{"filepath": "a.gopart", "content": "x", "insert-before": "b"}`}, wantErr: true},
+		{name: "delete with content", call: ToolCall{Name: toolDeleteFile, Arguments: `{"filepath": "a.go", "content": "x"}`}, wantErr: true},
+		{name: "insert a Go file", call: ToolCall{Name: toolInsertFile, Arguments: `{"filepath": "a.go", "content": "x", "insert-after": "b"}`}, wantErr: true},
+		{name: "insert without insertion point", call: ToolCall{Name: toolInsertFile, Arguments: `{"filepath": "a.gopart", "content": "x"}`}, wantErr: true},
+		{name: "insert with both insertion points", call: ToolCall{Name: toolInsertFile, Arguments: `{"filepath": "a.gopart", "content": "x", "insert-before": "b", "insert-after": "c"}`}, wantErr: true},
+		{name: "unknown tool", call: ToolCall{Name: "run_shell", Arguments: `{"filepath": "a.go"}`}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := changeFromToolCall(tt.call)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("changeFromToolCall() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changeFromToolCall() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToolCallChecker(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "main.go"), "package main\n")
+	writeFile(t, filepath.Join(dir, "editor/main/main.gopart"), "func main() {}\n")
+
+	// each call sees the project as the calls before it leave it
+	calls := []struct {
+		call        ToolCall
+		wantOutcome string
+		wantErr     bool
+	}{
+		{call: ToolCall{Name: toolWriteFile, Arguments: `{"filepath": "main.go", "content": "package main\n"}`}, wantOutcome: "main.go will be replaced"},
+		{call: ToolCall{Name: toolWriteFile, Arguments: `{"filepath": "util.go", "content": "package main\n"}`}, wantOutcome: "util.go will be created"},
+		{call: ToolCall{Name: toolDeleteFile, Arguments: `{"filepath": "util.go"}`}, wantOutcome: "util.go will be deleted"},
+		{call: ToolCall{Name: toolDeleteFile, Arguments: `{"filepath": "util.go"}`}, wantErr: true},
+		{call: ToolCall{Name: toolDeleteFile, Arguments: `{"filepath": "missing.go"}`}, wantErr: true},
+		{call: ToolCall{Name: toolInsertFile, Arguments: `{"filepath": "editor/main/run.gopart", "content": "func run() {}\n", "insert-after": "main"}`}, wantOutcome: "editor/main/run.gopart will be created after main"},
+		{call: ToolCall{Name: toolInsertFile, Arguments: `{"filepath": "editor/main/stop.gopart", "content": "func stop() {}\n", "insert-before": "run"}`}, wantOutcome: "editor/main/stop.gopart will be created before run"},
+		{call: ToolCall{Name: toolInsertFile, Arguments: `{"filepath": "editor/main/run.gopart", "content": "func run() {}\n", "insert-after": "main"}`}, wantErr: true},
+		{call: ToolCall{Name: toolInsertFile, Arguments: `{"filepath": "editor/main/go.gopart", "content": "func goes() {}\n", "insert-after": "missing"}`}, wantErr: true},
+		{call: ToolCall{Name: toolWriteFile, Arguments: `{"filepath": "../main.go", "content": ""}`}, wantErr: true},
+	}
+	checker := newToolCallChecker(dir)
+	for i, tt := range calls {
+		_, outcome, err := checker.check(tt.call)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("call %d: check() error = %v, want error %v", i, err, tt.wantErr)
+			continue
+		}
+		if outcome != tt.wantOutcome {
+			t.Errorf("call %d: check() = %q, want %q", i, outcome, tt.wantOutcome)
+		}
+	}
+}
+
+func TestCompleteWithTools(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "main.go"), "package main\n")
+
+	responses := []ChatResponse{
+		{FinishReason: "tool_calls", ToolCalls: []ToolCall{
+			{Name: toolWriteFile, Arguments: `{"filepath": "main.go", "content": "package main\n\nfunc main() {}\n"}`},
+			{Name: toolDeleteFile, Arguments: `{"filepath": "missing.go"}`},
+		}},
+		{FinishReason: "tool_calls", ToolCalls: []ToolCall{
+			{ID: "call_x", Name: toolWriteFile, Arguments: `{"filepath": "run.go", "content": "package main\n"}`},
+		}},
+		{Content: "Done.", FinishReason: "stop"},
+	}
+	var requests []ChatRequest
+	send := func(request ChatRequest) (ChatResponse, error) {
+		requests = append(requests, request)
+		response := responses[0]
+		responses = responses[1:]
+		return response, nil
+	}
+
+	response, err := completeWithTools(dir, ChatRequest{Messages: []ChatMessage{{Role: RoleUser, Content: "Add main"}}}, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("sent %d requests, want 3", len(requests))
+	}
+
+	var results []ChatMessage
+	for _, message := range requests[2].Messages {
+		if message.Role == RoleTool {
+			results = append(results, message)
+		}
+	}
+	want := []ChatMessage{
+		{Role: RoleTool, Content: "main.go will be replaced", ToolCallID: "call_1_0"},
+		{Role: RoleTool, Content: "error: missing.go does not exist", ToolCallID: "call_1_1"},
+		{Role: RoleTool, Content: "run.go will be created", ToolCallID: "call_x"},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("tool results = %+v, want %+v", results, want)
+	}
+
+	if response.Content != "Done." || len(response.ToolCalls) != 3 {
+		t.Errorf("response = %+v, want the last one with all 3 tool calls", response)
+	}
+	changes := changesFromToolCalls(dir, response.ToolCalls)
+	wantChanges := []FileContent{
+		{FilePath: "main.go", Content: "package main\n\nfunc main() {}\n"},
+		{FilePath: "run.go", Content: "package main\n"},
+	}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("changesFromToolCalls() = %+v, want %+v", changes, wantChanges)
+	}
+}